@@ -0,0 +1,112 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+	"github.com/gorilla/mux"
+)
+
+func (s *Server) handleCreateAlbum() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		req := &model.Album{}
+		if err := s.bind(r, req); err != nil {
+			return err
+		}
+		u := s.currentUser(r.Context())
+		album := &model.Album{Name: req.Name}
+		if err := u.SaveAlbum(album); err != nil {
+			return err
+		}
+		album, err := u.GetAlbumByID(album.ID)
+		if err != nil {
+			return err
+		}
+		return album
+	})
+}
+
+func (s *Server) handleSaveAlbum() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		req := &model.Album{}
+		if err := s.bind(r, req); err != nil {
+			return err
+		}
+		u := s.currentUser(r.Context())
+		album, err := u.GetAlbumByID(util.Atoi64(mux.Vars(r)["id"]))
+		if err != nil {
+			return err
+		}
+		album.Name = req.Name
+		if err := u.SaveAlbum(album); err != nil {
+			return err
+		}
+		album, err = u.GetAlbumByID(album.ID)
+		if err != nil {
+			return err
+		}
+		return album
+	})
+}
+
+func (s *Server) handleGetAlbums() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		albums, err := u.GetAlbums()
+		if err != nil {
+			return err
+		}
+		return s.cursor(albums, 1)
+	})
+}
+
+func (s *Server) handleGetAlbum() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		album, err := u.GetAlbumByID(util.Atoi64(mux.Vars(r)["id"]))
+		if err != nil {
+			return err
+		}
+		return album
+	})
+}
+
+func (s *Server) handleDeleteAlbum() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		return u.DeleteAlbumByID(util.Atoi64(mux.Vars(r)["id"]))
+	})
+}
+
+func (s *Server) handleGetAlbumMedia() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		page, limit := s.pageParams(r)
+		medias, total, err := u.GetAlbumMedia(util.Atoi64(mux.Vars(r)["id"]), page, limit)
+		if err != nil {
+			return err
+		}
+		s.hideExif(r, medias)
+		return s.cursor(medias, s.pages(total, limit))
+	})
+}
+
+func (s *Server) handleAddAlbumMedia() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		v := mux.Vars(r)
+		ids := util.StringsToInt64(strings.Split(v["ids"], "-"))
+		return u.AddAlbumMedia(util.Atoi64(v["id"]), ids)
+	})
+}
+
+func (s *Server) handleRemoveAlbumMedia() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		v := mux.Vars(r)
+		ids := util.StringsToInt64(strings.Split(v["ids"], "-"))
+		return u.RemoveAlbumMedia(util.Atoi64(v["id"]), ids)
+	})
+}
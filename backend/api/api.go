@@ -7,10 +7,12 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,6 +51,7 @@ type (
 	listResponse struct {
 		Result interface{} `json:"result"`
 		Pages  int         `json:"pages"`
+		Next   string      `json:"next,omitempty"`
 	}
 )
 
@@ -102,7 +105,7 @@ func NewServer() *Server {
 	})
 
 	r.Use(handlers.CORS(
-		handlers.AllowedHeaders([]string{"Accept", "Accept-Language", "Content-Type", "Content-Language", "Origin", "Authorization"}),
+		handlers.AllowedHeaders([]string{"Accept", "Accept-Language", "Content-Type", "Content-Language", "Origin", "Authorization", "Upload-Offset"}),
 		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "DELETE", "PATCH", "PUT", "OPTIONS"}),
 		handlers.AllowedOrigins([]string{"*"}),
 		handlers.AllowCredentials(),
@@ -117,23 +120,53 @@ func NewServer() *Server {
 	sr.HandleFunc("/users/{id}", srv.handleSaveUser()).Methods(http.MethodPut)
 	sr.HandleFunc("/users", srv.handleGetUser()).Methods(http.MethodGet)
 
+	sr.HandleFunc("/syncs/types", srv.handleGetSyncTypes()).Methods(http.MethodGet)
 	sr.HandleFunc("/syncs", srv.handleCreateSyncLocation()).Methods(http.MethodPost)
 	sr.HandleFunc("/syncs/{id}", srv.handleSaveSyncLocation()).Methods(http.MethodPut)
 	sr.HandleFunc("/syncs/{id}", srv.handleDeleteSync()).Methods(http.MethodDelete)
 	sr.HandleFunc("/syncs", srv.handleGetSync()).Methods(http.MethodGet)
 
 	sr.HandleFunc("/media", srv.handleGetAllMedia()).Methods(http.MethodGet)
+	sr.HandleFunc("/media/search", srv.handleSearchMedia()).Methods(http.MethodGet)
+	sr.HandleFunc("/media/changes", srv.handleMediaChanges()).Methods(http.MethodGet)
+	sr.HandleFunc("/media/exists", srv.handleMediaExists()).Methods(http.MethodPost)
+	sr.HandleFunc("/media/duplicates", srv.handleSimilarMedia()).Methods(http.MethodGet)
+	sr.HandleFunc("/media/geo", srv.handleGeoMedia()).Methods(http.MethodGet)
 	sr.HandleFunc("/media/{id}", srv.handleGetMedia()).Methods(http.MethodGet)
 	sr.HandleFunc("/media/{id}", srv.handleDeleteMedia()).Methods(http.MethodDelete)
 	sr.HandleFunc("/media/{id}/restore", srv.handleRestoreMedia()).Methods(http.MethodPatch)
 
+	sr.HandleFunc("/albums", srv.handleCreateAlbum()).Methods(http.MethodPost)
+	sr.HandleFunc("/albums", srv.handleGetAlbums()).Methods(http.MethodGet)
+	sr.HandleFunc("/albums/{id}", srv.handleGetAlbum()).Methods(http.MethodGet)
+	sr.HandleFunc("/albums/{id}", srv.handleSaveAlbum()).Methods(http.MethodPut)
+	sr.HandleFunc("/albums/{id}", srv.handleDeleteAlbum()).Methods(http.MethodDelete)
+	sr.HandleFunc("/albums/{id}/media", srv.handleGetAlbumMedia()).Methods(http.MethodGet)
+	sr.HandleFunc("/albums/{id}/media/{ids}", srv.handleAddAlbumMedia()).Methods(http.MethodPut)
+	sr.HandleFunc("/albums/{id}/media/{ids}", srv.handleRemoveAlbumMedia()).Methods(http.MethodDelete)
+
 	sr.HandleFunc("/upload", srv.handleUpload()).Methods(http.MethodPost)
 	sr.HandleFunc("/upload/dir", srv.handleUploadDir()).Methods(http.MethodPost)
+	sr.HandleFunc("/upload/sessions", srv.handleCreateUploadSession()).Methods(http.MethodPost)
+	sr.HandleFunc("/upload/sessions/{id}", srv.handleGetUploadSession()).Methods(http.MethodGet)
+	sr.HandleFunc("/upload/sessions/{id}", srv.handleWriteUploadSession()).Methods(http.MethodPatch)
+	sr.HandleFunc("/upload/sessions/{id}", srv.handleDeleteUploadSession()).Methods(http.MethodDelete)
+	sr.HandleFunc("/upload/sessions/{id}/finish", srv.handleFinishUploadSession()).Methods(http.MethodPost)
+
+	sr.HandleFunc("/places", srv.handleGetPlaces()).Methods(http.MethodGet)
+
+	sr.HandleFunc("/jobs", srv.handleGetJobs()).Methods(http.MethodGet)
+	sr.HandleFunc("/jobs/stats", srv.handleGetJobStats()).Methods(http.MethodGet)
 
 	dlr := r.PathPrefix("/{user}/{date}/{id}/{file}").Subrouter()
 	dlr.Use(srv.auth)
 	dlr.HandleFunc("", srv.handleDownload()).Methods(http.MethodGet)
 
+	go srv.cleanUploadSessions()
+	go model.Backfill()
+	model.RegisterJob(model.JobUploadDir, jobUploadDir)
+	go model.StartJobWorkers(util.JobWorkers)
+
 	if adminCode == "" {
 		adminCode = util.NewID()
 		log.Printf("Use AdminCode: %s to register as a new admin", adminCode)
@@ -196,6 +229,10 @@ func (s *Server) writeError(w http.ResponseWriter, err error) bool {
 	} else if _, ok := err.(*json.SyntaxError); ok {
 		log.Printf("JsonSyntaxError: %v", err)
 		code = http.StatusBadRequest
+	} else if err == model.ErrTooLarge {
+		code = http.StatusRequestEntityTooLarge
+	} else if err == model.ErrOffset {
+		code = http.StatusConflict
 	} else if err == errAuth {
 		code = http.StatusUnauthorized
 	} else if err == errNotFound || err == model.ErrNotFound {
@@ -276,6 +313,28 @@ func (s *Server) cursor(list interface{}, pages int) interface{} {
 	return listResponse{Result: list, Pages: pages}
 }
 
+// pageParams reads the p and l query parameters used by paged listings
+func (s *Server) pageParams(r *http.Request) (int, int) {
+	page, _ := strconv.Atoi(s.QueryParam(r, "p"))
+	limit, _ := strconv.Atoi(s.QueryParam(r, "l"))
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+	if page <= 0 {
+		page = 1
+	}
+	return page, limit
+}
+
+// pages returns the number of pages for total items, always at least 1
+func (s *Server) pages(total int, limit int) int {
+	pages := int(math.Ceil(float64(total) / float64(limit)))
+	if pages <= 0 {
+		pages = 1
+	}
+	return pages
+}
+
 func (s *Server) auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/api/users" && r.Method == http.MethodPost {
@@ -1,38 +1,19 @@
 package api
 
 import (
-	"bufio"
-	"bytes"
-	"image/jpeg"
-	"io"
+	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/altlimit/dmedia/model"
 	"github.com/altlimit/dmedia/util"
 	"github.com/gorilla/mux"
-	resizer "github.com/nfnt/resize"
 )
 
-func resizeImage(w io.Writer, fPath string, width uint) error {
-	file, err := os.Open(fPath)
-	if err != nil {
-		return err
-	}
-
-	img, err := jpeg.Decode(file)
-	if err != nil {
-		return err
-	}
-	file.Close()
-
-	m := resizer.Resize(width, 0, img, resizer.Lanczos3)
-	return jpeg.Encode(w, m, nil)
-}
-
 func (s *Server) handleDownload() http.HandlerFunc {
 	fs := http.FileServer(http.Dir(util.DataPath))
 	return func(wr http.ResponseWriter, r *http.Request) {
@@ -42,40 +23,53 @@ func (s *Server) handleDownload() http.HandlerFunc {
 			return
 		}
 		size := s.QueryParam(r, "size")
+		variant := s.QueryParam(r, "variant")
 		p := filepath.Join(util.DataPath, r.URL.Path)
-		if size != "" {
-			item, err := s.Cache.Fetch("dl:"+size+":"+r.URL.Path, time.Hour*24, func() (interface{}, error) {
-				cType := util.TypeByExt(filepath.Ext(p))
-				if strings.Index(cType, "image/") != 0 {
-					np := p + ".jpg"
-					if !util.FileExists(np) {
-						if err := util.Thumbnail(p); err != nil {
-							return nil, err
-						}
-					}
-					p = np
-				}
-				sz, err := strconv.Atoi(size)
+		if size != "" || variant != "" {
+			sz, err := strconv.Atoi(size)
+			if size != "" && (err != nil || sz <= 0) {
+				s.writeError(wr, newValidationErr("size", "invalid"))
+				return
+			}
+			if !util.FileExists(p) {
+				s.writeError(wr, errNotFound)
+				return
+			}
+			m, err := s.currentUser(r.Context()).GetMediaByID(util.Atoi64(v["id"]))
+			if err != nil {
+				s.writeError(wr, err)
+				return
+			}
+			if variant != "" {
+				vp, err := model.VariantPath(p, m, variant)
 				if err != nil {
-					return nil, err
+					s.writeError(wr, err)
+					return
 				}
-				var b bytes.Buffer
-				br := bufio.NewWriter(&b)
-				if err := resizeImage(br, p, uint(sz)); err != nil {
-					return nil, err
+				cType := util.TypeByExt(filepath.Ext(vp))
+				if vp == p {
+					cType = m.ContentType
 				}
-				return b.Bytes(), nil
-			})
-			if err != nil {
-				s.writeError(wr, err)
+				s.serveDerived(wr, r, vp, cType, fmt.Sprintf(`"%s-%s"`, m.Checksum, strings.ReplaceAll(variant, "/", "-")))
 				return
 			}
-			b := item.Value().([]byte)
-			wr.Header().Set("Content-Type", "image/jpeg")
-			wr.Header().Set("Content-Length", strconv.Itoa(len(b)))
-			if _, err := wr.Write(b); err != nil {
+			// clients that accept webp get it when ffmpeg can encode it, falling back to jpeg when it fails
+			format, cType := model.ThumbJPEG, "image/jpeg"
+			if util.HasFFmpeg && strings.Contains(r.Header.Get("Accept"), "image/webp") {
+				format, cType = model.ThumbWebP, "image/webp"
+			}
+			tp, err := model.Thumbnail(p, sz, format)
+			if err != nil && format == model.ThumbWebP {
+				log.Printf("handleDownload webp %s error: %v", p, err)
+				cType = "image/jpeg"
+				tp, err = model.Thumbnail(p, sz, model.ThumbJPEG)
+			}
+			if err != nil {
 				s.writeError(wr, err)
+				return
 			}
+			wr.Header().Set("Vary", "Accept")
+			s.serveDerived(wr, r, tp, cType, fmt.Sprintf(`"%s-%s"`, m.Checksum, filepath.Base(tp)))
 			return
 		}
 		ext := strings.ToLower(filepath.Ext(p))
@@ -85,3 +79,23 @@ func (s *Server) handleDownload() http.HandlerFunc {
 		fs.ServeHTTP(wr, r)
 	}
 }
+
+// serveDerived serves a file generated from a media with range and conditional request support,
+// a media never changes content so its derived files are identified by its checksum
+func (s *Server) serveDerived(wr http.ResponseWriter, r *http.Request, fPath string, cType string, etag string) {
+	file, err := os.Open(fPath)
+	if err != nil {
+		s.writeError(wr, err)
+		return
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		s.writeError(wr, err)
+		return
+	}
+	wr.Header().Set("Content-Type", cType)
+	wr.Header().Set("ETag", etag)
+	wr.Header().Set("Cache-Control", "private, max-age=604800")
+	http.ServeContent(wr, r, filepath.Base(fPath), fi.ModTime(), file)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/altlimit/dmedia/model"
+)
+
+func (s *Server) handleGetJobs() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		status := s.QueryParam(r, "status")
+		switch status {
+		case "", model.JobQueued, model.JobRunning, model.JobDone, model.JobFailed:
+		default:
+			return newValidationErr("status", "invalid")
+		}
+		page, limit := s.pageParams(r)
+		jobs, total, err := u.GetJobs(status, page, limit)
+		if err != nil {
+			return err
+		}
+		return s.cursor(jobs, s.pages(total, limit))
+	})
+}
+
+func (s *Server) handleGetJobStats() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		stats, err := s.currentUser(r.Context()).GetJobStats()
+		if err != nil {
+			return err
+		}
+		return stats
+	})
+}
@@ -1,11 +1,12 @@
 package api
 
 import (
-	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/altlimit/dmedia/model"
 	"github.com/altlimit/dmedia/sync"
 	"github.com/altlimit/dmedia/util"
 	"github.com/gorilla/mux"
@@ -14,24 +15,257 @@ import (
 func (s *Server) handleGetAllMedia() http.HandlerFunc {
 	return s.handler(func(r *http.Request) interface{} {
 		u := s.currentUser(r.Context())
-		deleted := s.QueryParam(r, "deleted")
-		page, _ := strconv.Atoi(s.QueryParam(r, "p"))
-		limit, _ := strconv.Atoi(s.QueryParam(r, "l"))
-		if limit <= 0 || limit > 100 {
-			limit = 100
+		filter, err := s.mediaFilter(r)
+		if err != nil {
+			return err
+		}
+		page, limit := s.pageParams(r)
+		// c switches to keyset paging, empty for the first page then the returned next token
+		if _, ok := r.URL.Query()["c"]; ok {
+			var cursor *model.MediaCursor
+			if c := s.QueryParam(r, "c"); c != "" {
+				cursor, err = model.DecodeMediaCursor(c)
+				if err != nil {
+					return newValidationErr("c", "invalid")
+				}
+			}
+			medias, next, err := u.GetMediaAfter(filter, cursor, limit)
+			if err != nil {
+				return err
+			}
+			total, err := u.CountMedia(filter)
+			if err != nil {
+				return err
+			}
+			s.hideExif(r, medias)
+			resp := listResponse{Result: medias, Pages: s.pages(total, limit)}
+			if next != nil {
+				resp.Next = next.Encode()
+			}
+			return resp
+		}
+		medias, total, err := u.GetAllMedia(filter, page, limit)
+		if err != nil {
+			return err
+		}
+		s.hideExif(r, medias)
+		return s.cursor(medias, s.pages(total, limit))
+	})
+}
+
+// hideExif drops the raw exif dump of medias unless it's asked for with exif=1,
+// the typed photo info is always returned
+func (s *Server) hideExif(r *http.Request, medias []model.Media) {
+	if s.QueryParam(r, "exif") == "1" {
+		return
+	}
+	for i := range medias {
+		if medias[i].Meta != nil {
+			medias[i].Meta.Exif = nil
+		}
+	}
+}
+
+// mediaFilter reads the optional media listing filters:
+// deleted=1, from & to (date or date time), ctype (image or video), name, min & max (size in bytes),
+// country, city, make, model & lens
+func (s *Server) mediaFilter(r *http.Request) (*model.MediaFilter, error) {
+	filter := &model.MediaFilter{Deleted: s.QueryParam(r, "deleted") == "1"}
+	if from := s.QueryParam(r, "from"); from != "" {
+		t, _, ok := parseDate(from)
+		if !ok {
+			return nil, newValidationErr("from", "invalid")
+		}
+		filter.From = &t
+	}
+	if to := s.QueryParam(r, "to"); to != "" {
+		t, dateOnly, ok := parseDate(to)
+		if !ok {
+			return nil, newValidationErr("to", "invalid")
+		}
+		// to is inclusive for the client, the filter bound is exclusive
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		} else {
+			t = t.Add(time.Second)
+		}
+		filter.To = &t
+	}
+	if cType := strings.ToLower(s.QueryParam(r, "ctype")); cType != "" {
+		if !strings.Contains(cType, "/") {
+			cType += "/"
+		}
+		if strings.Index(cType, "image/") != 0 && strings.Index(cType, "video/") != 0 {
+			return nil, newValidationErr("ctype", "invalid")
+		}
+		filter.CType = cType
+	}
+	filter.Name = s.QueryParam(r, "name")
+	filter.Country = s.QueryParam(r, "country")
+	filter.City = s.QueryParam(r, "city")
+	filter.Make = s.QueryParam(r, "make")
+	filter.Model = s.QueryParam(r, "model")
+	filter.Lens = s.QueryParam(r, "lens")
+	for param, size := range map[string]*int64{"min": &filter.MinSize, "max": &filter.MaxSize} {
+		if v := s.QueryParam(r, param); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, newValidationErr(param, "invalid")
+			}
+			*size = n
+		}
+	}
+	return filter, nil
+}
+
+// parseDate accepts either a date or a date time, dateOnly is true for the former
+func parseDate(v string) (t time.Time, dateOnly bool, ok bool) {
+	if t, err := time.Parse(util.DateTimeFormat, v); err == nil {
+		return t, false, true
+	}
+	if t, err := time.Parse(util.DateFormat, v); err == nil {
+		return t, true, true
+	}
+	return t, false, false
+}
+
+func (s *Server) handleSearchMedia() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		q := s.QueryParam(r, "q")
+		if strings.TrimSpace(q) == "" {
+			return newValidationErr("q", "required")
+		}
+		page, limit := s.pageParams(r)
+		medias, total, err := u.SearchMedia(q, page, limit)
+		if err != nil {
+			return err
+		}
+		s.hideExif(r, medias)
+		return s.cursor(medias, s.pages(total, limit))
+	})
+}
+
+func (s *Server) handleMediaChanges() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		changes, err := u.GetMediaChanges(s.QueryParam(r, "since"))
+		if err != nil {
+			if err == model.ErrInvalidCursor {
+				return newValidationErr("since", "invalid")
+			}
+			return err
+		}
+		s.hideExif(r, changes.Changed)
+		return changes
+	})
+}
+
+// handleMediaExists lets clients skip uploading media the server already has,
+// found maps each existing checksum to its media id
+func (s *Server) handleMediaExists() http.HandlerFunc {
+	type (
+		existsItem struct {
+			Checksum string `json:"checksum" validate:"required,len=40,hexadecimal"`
+			Size     int    `json:"size" validate:"min=0"`
+		}
+		existsRequest struct {
+			Items []existsItem `json:"items" validate:"required,max=1000,dive"`
+		}
+	)
+	return s.handler(func(r *http.Request) interface{} {
+		req := &existsRequest{}
+		if err := s.bind(r, req); err != nil {
+			return err
+		}
+		var checksums []string
+		for _, item := range req.Items {
+			checksums = append(checksums, strings.ToLower(item.Checksum))
+		}
+		u := s.currentUser(r.Context())
+		medias, err := u.GetMediaByChecksums(checksums)
+		if err != nil {
+			return err
+		}
+		found := make(map[string]int64)
+		for _, item := range req.Items {
+			m, ok := medias[strings.ToLower(item.Checksum)]
+			// a size that doesn't match means a different file
+			if !ok || (item.Size > 0 && item.Size != m.Size) {
+				continue
+			}
+			found[item.Checksum] = m.ID
+		}
+		return map[string]interface{}{"found": found}
+	})
+}
+
+// handleSimilarMedia groups near-duplicate photos, d is the max hamming distance of their hashes
+func (s *Server) handleSimilarMedia() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		distance := 6
+		if d := s.QueryParam(r, "d"); d != "" {
+			var err error
+			distance, err = strconv.Atoi(d)
+			if err != nil || distance < 0 || distance > 16 {
+				return newValidationErr("d", "invalid")
+			}
+		}
+		u := s.currentUser(r.Context())
+		groups, err := u.GetSimilarMedia(distance)
+		if err != nil {
+			return err
 		}
-		if page <= 0 {
-			page = 1
+		for _, g := range groups {
+			s.hideExif(r, g)
 		}
-		medias, total, err := u.GetAllMedia(deleted == "1", page, limit)
+		return s.cursor(groups, 1)
+	})
+}
+
+func (s *Server) handleGetPlaces() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		places, err := s.currentUser(r.Context()).GetPlaces()
 		if err != nil {
 			return err
 		}
-		pages := int(math.Ceil(float64(total) / float64(limit)))
-		if pages <= 0 {
-			pages = 1
+		return s.cursor(places, 1)
+	})
+}
+
+// handleGeoMedia clusters located media in bbox (west,south,east,north) for a map at zoom,
+// the media listing filters also apply
+func (s *Server) handleGeoMedia() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		var bbox model.BBox
+		coords := strings.Split(s.QueryParam(r, "bbox"), ",")
+		if len(coords) != 4 {
+			return newValidationErr("bbox", "required")
+		}
+		for i, c := range []*float64{&bbox.West, &bbox.South, &bbox.East, &bbox.North} {
+			v, err := strconv.ParseFloat(strings.TrimSpace(coords[i]), 64)
+			if err != nil {
+				return newValidationErr("bbox", "invalid")
+			}
+			*c = v
+		}
+		if bbox.South > bbox.North || bbox.South < -90 || bbox.North > 90 ||
+			bbox.West < -180 || bbox.West > 180 || bbox.East < -180 || bbox.East > 180 {
+			return newValidationErr("bbox", "invalid")
+		}
+		zoom, err := strconv.Atoi(s.QueryParam(r, "zoom"))
+		if err != nil || zoom < 0 || zoom > 22 {
+			return newValidationErr("zoom", "invalid")
+		}
+		filter, err := s.mediaFilter(r)
+		if err != nil {
+			return err
+		}
+		clusters, err := s.currentUser(r.Context()).GetGeoClusters(filter, bbox, util.GeohashPrecision(zoom))
+		if err != nil {
+			return err
 		}
-		return s.cursor(medias, pages)
+		return s.cursor(clusters, 1)
 	})
 }
 
@@ -43,7 +277,9 @@ func (s *Server) handleGetMedia() http.HandlerFunc {
 		if err != nil {
 			return err
 		}
-		return media
+		medias := []model.Media{*media}
+		s.hideExif(r, medias)
+		return medias[0]
 	})
 }
 
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"io"
+	"log"
 	"net/http"
 
 	"github.com/altlimit/dmedia/model"
@@ -9,24 +11,55 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// syncLocationErr returns a validation error for each invalid config field as config.{field}
+func syncLocationErr(u *model.User, loc *model.SyncLocation) error {
+	syncer, err := sync.SyncFromLocation(u, loc)
+	if err == nil {
+		if c, ok := syncer.(io.Closer); ok {
+			c.Close()
+		}
+		return nil
+	}
+	if err == sync.ErrType {
+		return newValidationErr("type", "invalid")
+	}
+	if errs, ok := err.(sync.ConfigError); ok {
+		ve := validationError{Params: make(map[string]string)}
+		for k, v := range errs {
+			ve.Params["config."+k] = v
+		}
+		return ve
+	}
+	if err != sync.ErrConfig {
+		log.Println("syncLocationErr", loc.Type, err)
+	}
+	return newValidationErr("config", "invalid")
+}
+
+func (s *Server) handleGetSyncTypes() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		if u == nil {
+			return errAuth
+		}
+		return sync.Targets(u)
+	})
+}
+
 func (s *Server) handleCreateSyncLocation() http.HandlerFunc {
 	return s.handler(func(r *http.Request) interface{} {
 		req := &model.SyncLocation{}
 		if err := s.bind(r, req); err != nil {
 			return err
 		}
-		_, err := sync.SyncFromLocation(req)
-		if err != nil {
-			if err == sync.ErrType {
-				return newValidationErr("type", "invalid")
-			}
-			return newValidationErr("config", "invalid")
-		}
 		ctx := r.Context()
 		u := s.currentUser(ctx)
 		if u == nil {
 			return errAuth
 		}
+		if err := syncLocationErr(u, req); err != nil {
+			return err
+		}
 		if err := req.Save(u); err != nil {
 			return err
 		}
@@ -56,12 +89,8 @@ func (s *Server) handleSaveSyncLocation() http.HandlerFunc {
 		loc.Config = req.Config
 		loc.Deleted = req.Deleted
 
-		_, err = sync.SyncFromLocation(loc)
-		if err != nil {
-			if err == sync.ErrType {
-				return newValidationErr("type", "invalid")
-			}
-			return newValidationErr("config", "invalid")
+		if err := syncLocationErr(u, loc); err != nil {
+			return err
 		}
 
 		if err := loc.Save(u); err != nil {
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+	"github.com/go-playground/validator/v10"
+	"github.com/karlseguin/ccache/v2"
+)
+
+// testServer is a server with u signed in, it has no routes or database
+func testServer(u *model.User) *Server {
+	s := &Server{
+		validate: validator.New(),
+		Cache:    ccache.New(ccache.Configure()),
+	}
+	s.Cache.Set("user:1", u, time.Hour)
+	return s
+}
+
+func TestCreateSyncLocationErrors(t *testing.T) {
+	dp, roots := util.DataPath, util.SyncLocalRoots
+	defer func() { util.DataPath, util.SyncLocalRoots = dp, roots }()
+	util.DataPath = t.TempDir()
+	util.SyncLocalRoots = nil
+
+	tests := []struct {
+		name  string
+		admin bool
+		body  string
+		want  map[string]string
+	}{
+		{"unknown type", false, `{"name":"a","type":"ftp","config":{}}`,
+			map[string]string{"type": "invalid"}},
+		{"local needs admin", false, `{"name":"a","type":"local","config":{"root":"/tmp"}}`,
+			map[string]string{"type": "invalid"}},
+		{"required fields", false, `{"name":"a","type":"s3","config":{"prefix":"p/"}}`,
+			map[string]string{"config.endpoint": "required", "config.bucket": "required", "config.accessKey": "required", "config.secretKey": "required"}},
+		{"wrong types", false, `{"name":"a","type":"s3","config":{"endpoint":"https://s3.test","bucket":1,"accessKey":"k","secretKey":"s","pathStyle":"yes"}}`,
+			map[string]string{"config.bucket": "invalid", "config.pathStyle": "invalid"}},
+		{"field checks", false, `{"name":"a","type":"s3","config":{"endpoint":"s3.test","bucket":"a b","accessKey":"k","secretKey":"s"}}`,
+			map[string]string{"config.endpoint": "invalid url", "config.bucket": "invalid"}},
+		{"cross field", false, `{"name":"a","type":"sftp","config":{"host":"127.0.0.1:1","username":"u","insecureSkipHostKey":true}}`,
+			map[string]string{"config.password": "required"}},
+		{"local root", true, `{"name":"a","type":"local","config":{"root":"` + util.DataPath + `"}}`,
+			map[string]string{"config.root": "not allowed"}},
+		{"rejected by the target", false, `{"name":"a","type":"webdav","config":{"url":"http://127.0.0.1:1"}}`,
+			map[string]string{"config": "invalid"}},
+	}
+	for _, tt := range tests {
+		s := testServer(&model.User{ID: 1, IsAdmin: tt.admin})
+		r := httptest.NewRequest(http.MethodPost, "/api/syncs", strings.NewReader(tt.body))
+		r = r.WithContext(context.WithValue(r.Context(), KeyUser, int64(1)))
+		w := httptest.NewRecorder()
+		s.handleCreateSyncLocation().ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400 %s", tt.name, w.Code, w.Body)
+			continue
+		}
+		var resp struct {
+			Error  string            `json:"error"`
+			Params map[string]string `json:"params"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: response %s error %v", tt.name, w.Body, err)
+		}
+		if resp.Error != "validation" || !reflect.DeepEqual(resp.Params, tt.want) {
+			t.Errorf("%s: response %s %v, want validation %v", tt.name, resp.Error, resp.Params, tt.want)
+		}
+	}
+}
+
+func TestGetSyncTypes(t *testing.T) {
+	roots := util.SyncLocalRoots
+	defer func() { util.SyncLocalRoots = roots }()
+	util.SyncLocalRoots = nil
+
+	for _, admin := range []bool{false, true} {
+		s := testServer(&model.User{ID: 1, IsAdmin: admin})
+		r := httptest.NewRequest(http.MethodGet, "/api/syncs/types", nil)
+		r = r.WithContext(context.WithValue(r.Context(), KeyUser, int64(1)))
+		w := httptest.NewRecorder()
+		s.handleGetSyncTypes().ServeHTTP(w, r)
+		var types []struct {
+			Type   string                   `json:"type"`
+			Fields []map[string]interface{} `json:"fields"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &types); err != nil {
+			t.Fatalf("response %s error %v", w.Body, err)
+		}
+		var local bool
+		for _, st := range types {
+			local = local || st.Type == "local"
+			for _, f := range st.Fields {
+				if f["name"] == nil || f["type"] == nil || f["check"] != nil {
+					t.Errorf("%s field %v", st.Type, f)
+				}
+			}
+		}
+		if local != admin {
+			t.Errorf("admin %v has local %v", admin, local)
+		}
+	}
+}
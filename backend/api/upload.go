@@ -1,29 +1,74 @@
 package api
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/altlimit/dmedia/model"
-	"github.com/altlimit/dmedia/sync"
 	"github.com/altlimit/dmedia/util"
+	"github.com/gorilla/mux"
 )
 
 func (s *Server) handleUpload() http.HandlerFunc {
 	return s.handler(func(r *http.Request) interface{} {
 		var (
-			cType   string
-			content []byte
+			fName        string
+			fallbackDate string
+			blobURL      string
+			cType        string
+			content      io.Reader
 		)
-		fName := r.FormValue("name")
-		fallbackDate := r.FormValue("fallbackDate")
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			fName = r.FormValue("name")
+			fallbackDate = r.FormValue("fallbackDate")
+			blobURL = r.FormValue("url")
+		} else {
+			mr, err := r.MultipartReader()
+			if err != nil {
+				return err
+			}
+			// the file part is streamed as is so fields have to be sent before it
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if part.FormName() == "file" {
+					cType = part.Header.Get("Content-Type")
+					if fName == "" {
+						fName = part.FileName()
+					}
+					content = part
+					break
+				}
+				val, err := ioutil.ReadAll(io.LimitReader(part, 4096))
+				if err != nil {
+					return err
+				}
+				switch part.FormName() {
+				case "name":
+					fName = string(val)
+				case "fallbackDate":
+					fallbackDate = string(val)
+				case "url":
+					blobURL = string(val)
+				}
+			}
+		}
 		// fetch from URL
-		blobURL := r.FormValue("url")
-		if blobURL != "" {
+		if content == nil && blobURL != "" {
 			if fName == "" {
 				fName = path.Base(blobURL)
 				if fName == "." || fName == "/" {
@@ -40,25 +85,14 @@ func (s *Server) handleUpload() http.HandlerFunc {
 				return err
 			}
 			defer resp.Body.Close()
-			content, err = ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return err
+			if util.MaxUploadSize > 0 && resp.ContentLength > util.MaxUploadSize {
+				return model.ErrTooLarge
 			}
+			content = resp.Body
 			cType = resp.Header.Get("Content-Type")
-		} else {
-			file, handler, err := r.FormFile("file")
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			cType = handler.Header.Get("Content-Type")
-			if fName == "" {
-				fName = handler.Filename
-			}
-			content, err = ioutil.ReadAll(file)
-			if err != nil {
-				return err
-			}
+		}
+		if content == nil {
+			return newValidationErr("file", "required")
 		}
 		if fName == "" {
 			return newValidationErr("name", "required")
@@ -68,47 +102,137 @@ func (s *Server) handleUpload() http.HandlerFunc {
 			return err
 		}
 
-		nameDate, ok := util.TimeFromString(fName)
-		if ok {
-			fallbackDate = nameDate.Format(util.DateTimeFormat)
+		id, err := u.AddMedia(fName, cType, content, uploadFallbackDate(fName, fallbackDate))
+		if err != nil {
+			if err == model.ErrNotSupported {
+				return newValidationErr("content_type", "not supported")
+			}
+			return err
+		}
+		return id
+	})
+}
+
+// uploadFallbackDate prefers a date found in the file name over the one sent by the client
+func uploadFallbackDate(name string, fallbackDate string) string {
+	nameDate, ok := util.TimeFromString(name)
+	if ok {
+		return nameDate.Format(util.DateTimeFormat)
+	}
+	return fallbackDate
+}
+
+func (s *Server) handleCreateUploadSession() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		req := &model.UploadSession{}
+		if err := s.bind(r, req); err != nil {
+			return err
+		}
+		if strings.Index(req.ContentType, "image/") != 0 && strings.Index(req.ContentType, "video/") != 0 {
+			return newValidationErr("ctype", "not supported")
+		}
+		if strings.ContainsAny(req.Name, `/\`) {
+			return newValidationErr("name", "invalid")
+		}
+		if req.FallbackDate != "" {
+			if _, err := time.Parse(util.DateTimeFormat, req.FallbackDate); err != nil {
+				return newValidationErr("fallbackDate", "invalid")
+			}
+		}
+		req.FallbackDate = uploadFallbackDate(req.Name, req.FallbackDate)
+		u := s.currentUser(r.Context())
+		if err := u.NewUploadSession(req); err != nil {
+			return err
+		}
+		return req
+	})
+}
+
+func (s *Server) handleGetUploadSession() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		us, err := u.GetUploadSession(mux.Vars(r)["id"])
+		if err != nil {
+			return err
+		}
+		return us
+	})
+}
+
+// handleWriteUploadSession appends the raw body at the Upload-Offset header,
+// on a conflict the client should get the session for the offset to resume from
+func (s *Server) handleWriteUploadSession() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			return newValidationErr("offset", "invalid")
 		}
+		u := s.currentUser(r.Context())
+		us, err := u.GetUploadSession(mux.Vars(r)["id"])
+		if err != nil {
+			return err
+		}
+		if err := us.Write(offset, r.ContentLength, r.Body); err != nil {
+			return err
+		}
+		return us
+	})
+}
 
-		id, err := u.AddMedia(fName, cType, content, fallbackDate)
+func (s *Server) handleFinishUploadSession() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		id, err := u.FinishUploadSession(mux.Vars(r)["id"])
 		if err != nil {
 			if err == model.ErrNotSupported {
 				return newValidationErr("content_type", "not supported")
 			}
 			return err
 		}
-		go sync.ScheduleSync(u.ID)
 		return id
 	})
 }
 
+func (s *Server) handleDeleteUploadSession() http.HandlerFunc {
+	return s.handler(func(r *http.Request) interface{} {
+		u := s.currentUser(r.Context())
+		return u.DeleteUploadSession(mux.Vars(r)["id"])
+	})
+}
+
+// cleanUploadSessions garbage collects abandoned resumable uploads
+func (s *Server) cleanUploadSessions() {
+	for {
+		model.CleanUploadSessions(util.UploadSessionTTL)
+		time.Sleep(time.Hour)
+	}
+}
+
 func (s *Server) handleUploadDir() http.HandlerFunc {
 	return s.handler(func(r *http.Request) interface{} {
 		ctx := r.Context()
 		uploadDir := filepath.Join(util.DataPath, util.I64toa(s.userID(ctx)), "upload")
 		if util.FileExists(uploadDir) {
 			log.Printf("Found Upload Dir")
-			u := s.currentUser(ctx)
-			go func() {
-				files, err := filePathWalkDir(uploadDir)
-				if err != nil {
-					log.Printf("Error Walk Dir: %v", err)
-					return
-				}
-				for _, file := range files {
-					id, err := u.AddMediaFromPath(file)
-					log.Printf("AddMedia: %d -> Err: %v -> %s", id, err, file)
-				}
-				go sync.ScheduleSync(u.ID)
-			}()
+			return model.QueueJob(s.userID(ctx), model.JobUploadDir, 0, uploadDir)
 		}
 		return nil
 	})
 }
 
+// jobUploadDir adds every file of the upload dir in the job payload
+func jobUploadDir(u *model.User, j *model.Job) error {
+	files, err := filePathWalkDir(j.Payload)
+	if err != nil {
+		return fmt.Errorf("jobUploadDir walk error: %v", err)
+	}
+	for _, file := range files {
+		id, err := u.AddMediaFromPath(file)
+		log.Printf("AddMedia: %d -> Err: %v -> %s", id, err, file)
+	}
+	return nil
+}
+
 func filePathWalkDir(root string) ([]string, error) {
 	var files []string
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
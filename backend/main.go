@@ -1,4 +1,8 @@
-// +build json1
+// sqlite needs the json1 and fts5 extensions for the media migrations so other builds fail here
+
+//go:build json1 && fts5
+// +build json1,fts5
+
 package main
 
 import (
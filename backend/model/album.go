@@ -0,0 +1,213 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/altlimit/dmedia/util"
+)
+
+type (
+	Album struct {
+		ID       int64    `json:"id" db:"id"`
+		Name     string   `json:"name" db:"name" validate:"required"`
+		Created  DateTime `json:"created" db:"created"`
+		Modified DateTime `json:"modified" db:"modified"`
+		Total    int      `json:"total" db:"total"`
+	}
+)
+
+// SaveAlbum creates or renames an album
+func (u *User) SaveAlbum(album *Album) error {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("SaveAlbum getDB error: %v", err)
+	}
+	if album.ID == 0 {
+		res, err := db.Exec(`
+		INSERT INTO album(name, created, modified)
+		VALUES(?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`, album.Name)
+		if err != nil {
+			return fmt.Errorf("SaveAlbum db insert error: %v", err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("SaveAlbum LastInsertId error: %v", err)
+		}
+		album.ID = id
+		return nil
+	}
+	res, err := db.Exec(`
+		UPDATE album SET
+		name = ?,
+		modified = CURRENT_TIMESTAMP
+		WHERE id = ?`, album.Name, album.ID)
+	if err != nil {
+		return fmt.Errorf("SaveAlbum db update error: %v", err)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (u *User) GetAlbums() ([]Album, error) {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("GetAlbums getDB error: %v", err)
+	}
+	albums := []Album{}
+	if err := db.Select(&albums, `
+		SELECT a.*, COUNT(m.id) AS total
+		FROM album a
+		LEFT JOIN album_media am ON am.album_id = a.id
+		LEFT JOIN media m ON m.id = am.media_id AND m.deleted IS NULL
+		GROUP BY a.id
+		ORDER BY a.name
+	`); err != nil {
+		return nil, fmt.Errorf("GetAlbums select error: %v", err)
+	}
+	return albums, nil
+}
+
+func (u *User) GetAlbumByID(id int64) (*Album, error) {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("GetAlbumByID getDB error: %v", err)
+	}
+	album := &Album{}
+	if err := db.Get(album, `
+		SELECT a.*, (
+			SELECT COUNT(1) FROM album_media am
+			JOIN media m ON m.id = am.media_id AND m.deleted IS NULL
+			WHERE am.album_id = a.id
+		) AS total
+		FROM album a
+		WHERE a.id = ?
+	`, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("GetAlbumByID db get error: %v", err)
+	}
+	return album, nil
+}
+
+// DeleteAlbumByID removes the album and its memberships, media are kept
+func (u *User) DeleteAlbumByID(id int64) error {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("DeleteAlbumByID getDB error: %v", err)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("DeleteAlbumByID Beginx error: %v", err)
+	}
+	res, err := tx.Exec(`DELETE FROM album WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("DeleteAlbumByID delete error %v -> Rollback: %v", err, tx.Rollback())
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM album_media WHERE album_id = ?`, id); err != nil {
+		return fmt.Errorf("DeleteAlbumByID delete media error %v -> Rollback: %v", err, tx.Rollback())
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("DeleteAlbumByID commit error %v -> Rollback: %v", err, tx.Rollback())
+	}
+	return nil
+}
+
+// AddAlbumMedia adds existing media to an album, ids already in the album are ignored
+func (u *User) AddAlbumMedia(albumID int64, ids []int64) error {
+	if _, err := u.GetAlbumByID(albumID); err != nil {
+		return err
+	}
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("AddAlbumMedia getDB error: %v", err)
+	}
+	cleanIDs := strings.Join(util.Int64ToStrings(ids), ",")
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("AddAlbumMedia Beginx error: %v", err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`
+		INSERT OR IGNORE INTO album_media(album_id, media_id, added)
+		SELECT ?, id, CURRENT_TIMESTAMP FROM media WHERE id IN (%s)
+	`, cleanIDs), albumID); err != nil {
+		return fmt.Errorf("AddAlbumMedia insert error %v -> Rollback: %v", err, tx.Rollback())
+	}
+	if _, err := tx.Exec(`UPDATE album SET modified = CURRENT_TIMESTAMP WHERE id = ?`, albumID); err != nil {
+		return fmt.Errorf("AddAlbumMedia update error %v -> Rollback: %v", err, tx.Rollback())
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("AddAlbumMedia commit error %v -> Rollback: %v", err, tx.Rollback())
+	}
+	return nil
+}
+
+// RemoveAlbumMedia removes media from an album without deleting them
+func (u *User) RemoveAlbumMedia(albumID int64, ids []int64) error {
+	if _, err := u.GetAlbumByID(albumID); err != nil {
+		return err
+	}
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("RemoveAlbumMedia getDB error: %v", err)
+	}
+	cleanIDs := strings.Join(util.Int64ToStrings(ids), ",")
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("RemoveAlbumMedia Beginx error: %v", err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`
+		DELETE FROM album_media WHERE album_id = ? AND media_id IN (%s)
+	`, cleanIDs), albumID); err != nil {
+		return fmt.Errorf("RemoveAlbumMedia delete error %v -> Rollback: %v", err, tx.Rollback())
+	}
+	if _, err := tx.Exec(`UPDATE album SET modified = CURRENT_TIMESTAMP WHERE id = ?`, albumID); err != nil {
+		return fmt.Errorf("RemoveAlbumMedia update error %v -> Rollback: %v", err, tx.Rollback())
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("RemoveAlbumMedia commit error %v -> Rollback: %v", err, tx.Rollback())
+	}
+	return nil
+}
+
+// GetAlbumMedia pages through the media of an album that are not in trash
+func (u *User) GetAlbumMedia(albumID int64, page int, limit int) ([]Media, int, error) {
+	if _, err := u.GetAlbumByID(albumID); err != nil {
+		return nil, 0, err
+	}
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("GetAlbumMedia getDB error: %v", err)
+	}
+	allMedia := []Media{}
+	err = db.Select(&allMedia, fmt.Sprintf(`
+		SELECT m.*
+		FROM media m
+		JOIN album_media am ON am.media_id = m.id
+		WHERE am.album_id = ? AND m.deleted IS NULL
+		ORDER BY m.created DESC
+		LIMIT %d
+		OFFSET %d
+	`, limit, (limit*page)-limit), albumID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("GetAlbumMedia db select error: %v", err)
+	}
+	var total int
+	if err := db.Get(&total, `
+		SELECT COUNT(1)
+		FROM media m
+		JOIN album_media am ON am.media_id = m.id
+		WHERE am.album_id = ? AND m.deleted IS NULL
+	`, albumID); err != nil {
+		return nil, 0, fmt.Errorf("GetAlbumMedia select count error %v", err)
+	}
+	return allMedia, total, nil
+}
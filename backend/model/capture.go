@@ -0,0 +1,205 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/altlimit/dmedia/util"
+)
+
+// capture date sources from the most to the least trusted
+const (
+	DateExif     = "exif"
+	DateVideo    = "video"
+	DateSidecar  = "sidecar"
+	DateFilename = "filename"
+	DateFallback = "fallback"
+)
+
+type (
+	// captureDate is a candidate time a media was taken, in the local time of where it was taken
+	// when hasOffset or the server otherwise
+	captureDate struct {
+		time      time.Time
+		hasOffset bool
+		source    string
+	}
+)
+
+var (
+	dateSources = []string{DateExif, DateVideo, DateSidecar, DateFilename, DateFallback}
+
+	// XMP dates by precedence, either as an attribute or an element
+	xmpDateRegexes = []*regexp.Regexp{
+		regexp.MustCompile(`exif:DateTimeOriginal(?:="|>)\s*([^"<]+)`),
+		regexp.MustCompile(`photoshop:DateCreated(?:="|>)\s*([^"<]+)`),
+		regexp.MustCompile(`xmp:CreateDate(?:="|>)\s*([^"<]+)`),
+	}
+	xmpOffsetLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00"}
+	xmpLocalLayouts  = []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04", "2006-01-02"}
+)
+
+// dateRank is the precedence of a source, media added before sources were recorded rank last
+func dateRank(source string) int {
+	for i, s := range dateSources {
+		if s == source {
+			return i
+		}
+	}
+	return len(dateSources)
+}
+
+// firstDate returns the candidate with the highest precedence
+func firstDate(dates ...*captureDate) *captureDate {
+	var first *captureDate
+	for _, d := range dates {
+		if d != nil && (first == nil || dateRank(d.source) < dateRank(first.source)) {
+			first = d
+		}
+	}
+	return first
+}
+
+// takenAt formats the date for PhotoInfo.TakenAt, nil for sources that only guess it
+func (d *captureDate) takenAt() *string {
+	if d.source == DateFilename || d.source == DateFallback {
+		return nil
+	}
+	s := d.time.Format(takenAtFormat)
+	if d.hasOffset {
+		s = d.time.Format(takenAtFormat + "-07:00")
+	}
+	return &s
+}
+
+// videoDate reads the capture time in the ffprobe format tags, the Apple one keeps the local offset
+// while creation_time is in UTC
+func videoDate(info interface{}) *captureDate {
+	m, _ := info.(map[string]interface{})
+	format, _ := m["format"].(map[string]interface{})
+	tags, _ := format["tags"].(map[string]interface{})
+	if s, ok := tags["com.apple.quicktime.creationdate"].(string); ok {
+		for _, layout := range []string{"2006-01-02T15:04:05-0700", time.RFC3339} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return &captureDate{time: t, hasOffset: true, source: DateVideo}
+			}
+		}
+	}
+	if s, ok := tags["creation_time"].(string); ok {
+		// cameras without a clock write the 1904 or 1970 epoch
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil && t.Year() > 1970 {
+			return &captureDate{time: t.In(time.Local), source: DateVideo}
+		}
+	}
+	return nil
+}
+
+// sidecarDate looks for a Google Takeout JSON or an XMP file next to a media file
+func sidecarDate(fPath string) *captureDate {
+	base := strings.TrimSuffix(fPath, filepath.Ext(fPath))
+	for _, p := range []string{fPath + ".json", fPath + ".supplemental-metadata.json", base + ".json"} {
+		if d := takeoutDate(p); d != nil {
+			return d
+		}
+	}
+	for _, p := range []string{fPath + ".xmp", base + ".xmp", base + ".XMP"} {
+		if d := xmpDate(p); d != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+// takeoutDate reads photoTakenTime of a Google Takeout metadata file
+func takeoutDate(p string) *captureDate {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	var takeout struct {
+		PhotoTakenTime struct {
+			Timestamp string `json:"timestamp"`
+		} `json:"photoTakenTime"`
+	}
+	if err := json.Unmarshal(b, &takeout); err != nil {
+		return nil
+	}
+	ts, err := strconv.ParseInt(takeout.PhotoTakenTime.Timestamp, 10, 64)
+	if err != nil || ts <= 0 {
+		return nil
+	}
+	return &captureDate{time: time.Unix(ts, 0).In(time.Local), source: DateSidecar}
+}
+
+// xmpDate reads the capture date of an XMP file
+func xmpDate(p string) *captureDate {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	for _, re := range xmpDateRegexes {
+		match := re.FindSubmatch(b)
+		if match == nil {
+			continue
+		}
+		v := strings.TrimSpace(string(match[1]))
+		for _, layout := range xmpOffsetLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return &captureDate{time: t, hasOffset: true, source: DateSidecar}
+			}
+		}
+		for _, layout := range xmpLocalLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return &captureDate{time: t, source: DateSidecar}
+			}
+		}
+	}
+	return nil
+}
+
+// setCaptureDate changes when a media was taken, its directory is named after the date so it's moved
+func (u *User) setCaptureDate(m *Media, d *captureDate) error {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("setCaptureDate getDB error: %v", err)
+	}
+	created := d.time.Format(util.DateTimeFormat)
+	oldDir := filepath.Dir(m.Path(u.ID))
+	newDir := filepath.Join(dataPath(u.ID), created[0:10], util.I64toa(m.ID))
+	if oldDir != newDir {
+		if err := os.MkdirAll(filepath.Dir(newDir), 0755); err != nil {
+			return fmt.Errorf("setCaptureDate mkdir error: %v", err)
+		}
+		if err := os.Rename(oldDir, newDir); err != nil {
+			return fmt.Errorf("setCaptureDate rename error: %v", err)
+		}
+	}
+	if _, err := db.Exec(`
+		UPDATE media
+		SET
+			created = ?,
+			taken_at = ?,
+			meta = json_set(CASE WHEN json_valid(meta) THEN meta ELSE '{}' END, '$.dateSource', ?),
+			modified = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, created, d.takenAt(), d.source, m.ID); err != nil {
+		if oldDir != newDir {
+			if err := os.Rename(newDir, oldDir); err != nil {
+				return fmt.Errorf("setCaptureDate rename back error: %v", err)
+			}
+		}
+		return fmt.Errorf("setCaptureDate update error: %v", err)
+	}
+	if oldDir != newDir {
+		// the old date directory is removed when that was its only media
+		os.Remove(filepath.Dir(oldDir))
+	}
+	return nil
+}
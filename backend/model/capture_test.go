@@ -0,0 +1,159 @@
+package model
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFirstDate(t *testing.T) {
+	exif := &captureDate{source: DateExif}
+	video := &captureDate{source: DateVideo}
+	sidecar := &captureDate{source: DateSidecar}
+	filename := &captureDate{source: DateFilename}
+	fallback := &captureDate{source: DateFallback}
+	legacy := &captureDate{source: ""}
+	tests := []struct {
+		name  string
+		dates []*captureDate
+		want  *captureDate
+	}{
+		{"none", nil, nil},
+		{"all nil", []*captureDate{nil, nil}, nil},
+		{"exif first", []*captureDate{fallback, filename, sidecar, video, exif}, exif},
+		{"video over sidecar", []*captureDate{sidecar, nil, video}, video},
+		{"sidecar over filename", []*captureDate{filename, sidecar}, sidecar},
+		{"filename over fallback", []*captureDate{fallback, filename}, filename},
+		{"fallback over unknown", []*captureDate{legacy, fallback}, fallback},
+		{"first of same rank", []*captureDate{filename, {source: DateFilename}}, filename},
+	}
+	for _, tt := range tests {
+		if got := firstDate(tt.dates...); got != tt.want {
+			t.Errorf("%s: firstDate() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestXmpDate(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		content   string
+		want      string
+		hasOffset bool
+	}{
+		{"attribute with offset", `<rdf:Description exif:DateTimeOriginal="2021-05-06T07:08:09+08:00"/>`, "2021-05-06T07:08:09+08:00", true},
+		{"element local", `<exif:DateTimeOriginal>2021-05-06T07:08:09</exif:DateTimeOriginal>`, "2021-05-06T07:08:09Z", false},
+		{"minutes with offset", `<rdf:Description xmp:CreateDate="2021-05-06T07:08-05:00"/>`, "2021-05-06T07:08:00-05:00", true},
+		{"date only", `<photoshop:DateCreated>2021-05-06</photoshop:DateCreated>`, "2021-05-06T00:00:00Z", false},
+		{"original before create", `<rdf:Description xmp:CreateDate="2020-01-01T00:00:00Z" exif:DateTimeOriginal="2019-02-03T04:05:06Z"/>`, "2019-02-03T04:05:06Z", true},
+		{"invalid falls through", `<rdf:Description exif:DateTimeOriginal="garbage" xmp:CreateDate="2018-01-02T03:04:05Z"/>`, "2018-01-02T03:04:05Z", true},
+		{"no date", `<rdf:Description xmp:Rating="5"/>`, "", false},
+	}
+	for i, tt := range tests {
+		p := filepath.Join(dir, string(rune('a'+i))+".xmp")
+		if err := ioutil.WriteFile(p, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got := xmpDate(p)
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("%s: xmpDate() = %+v, want nil", tt.name, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: xmpDate() = nil, want %s", tt.name, tt.want)
+			continue
+		}
+		if s := got.time.Format(time.RFC3339); s != tt.want || got.hasOffset != tt.hasOffset || got.source != DateSidecar {
+			t.Errorf("%s: xmpDate() = %s %v %s, want %s %v", tt.name, s, got.hasOffset, got.source, tt.want, tt.hasOffset)
+		}
+	}
+	if got := xmpDate(filepath.Join(dir, "missing.xmp")); got != nil {
+		t.Errorf("missing file: xmpDate() = %+v, want nil", got)
+	}
+}
+
+func TestTakeoutDate(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		want    int64
+	}{
+		{"timestamp", `{"photoTakenTime":{"timestamp":"1620284889","formatted":"May 6, 2021"}}`, 1620284889},
+		{"zero", `{"photoTakenTime":{"timestamp":"0"}}`, 0},
+		{"not a number", `{"photoTakenTime":{"timestamp":"yesterday"}}`, 0},
+		{"missing", `{"title":"a.jpg"}`, 0},
+		{"invalid json", `{`, 0},
+	}
+	for i, tt := range tests {
+		p := filepath.Join(dir, string(rune('a'+i))+".json")
+		if err := ioutil.WriteFile(p, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got := takeoutDate(p)
+		if tt.want == 0 {
+			if got != nil {
+				t.Errorf("%s: takeoutDate() = %+v, want nil", tt.name, got)
+			}
+			continue
+		}
+		if got == nil || got.time.Unix() != tt.want || got.hasOffset || got.source != DateSidecar {
+			t.Errorf("%s: takeoutDate() = %+v, want %d", tt.name, got, tt.want)
+		}
+	}
+	if got := takeoutDate(filepath.Join(dir, "missing.json")); got != nil {
+		t.Errorf("missing file: takeoutDate() = %+v, want nil", got)
+	}
+}
+
+func TestVideoDate(t *testing.T) {
+	info := func(tags map[string]interface{}) interface{} {
+		return map[string]interface{}{"format": map[string]interface{}{"tags": tags}}
+	}
+	tests := []struct {
+		name      string
+		info      interface{}
+		want      string
+		hasOffset bool
+	}{
+		{"apple offset", info(map[string]interface{}{
+			"com.apple.quicktime.creationdate": "2021-05-06T07:08:09+0800",
+			"creation_time":                    "2021-05-05T23:08:09.000000Z",
+		}), "2021-05-06T07:08:09+08:00", true},
+		{"apple rfc3339", info(map[string]interface{}{"com.apple.quicktime.creationdate": "2021-05-06T07:08:09-04:00"}), "2021-05-06T07:08:09-04:00", true},
+		{"creation time", info(map[string]interface{}{"creation_time": "2021-05-05T23:08:09.000000Z"}), "2021-05-05T23:08:09Z", false},
+		{"bad apple falls back", info(map[string]interface{}{
+			"com.apple.quicktime.creationdate": "garbage",
+			"creation_time":                    "2020-01-02T03:04:05Z",
+		}), "2020-01-02T03:04:05Z", false},
+		{"1970 epoch", info(map[string]interface{}{"creation_time": "1970-01-01T00:00:00.000000Z"}), "", false},
+		{"1904 epoch", info(map[string]interface{}{"creation_time": "1904-01-01T00:00:00.000000Z"}), "", false},
+		{"no tags", map[string]interface{}{"format": map[string]interface{}{}}, "", false},
+		{"nil", nil, "", false},
+	}
+	for _, tt := range tests {
+		got := videoDate(tt.info)
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("%s: videoDate() = %+v, want nil", tt.name, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: videoDate() = nil, want %s", tt.name, tt.want)
+			continue
+		}
+		want, _ := time.Parse(time.RFC3339, tt.want)
+		if !got.time.Equal(want) || got.hasOffset != tt.hasOffset || got.source != DateVideo {
+			t.Errorf("%s: videoDate() = %s %v %s, want %s %v", tt.name, got.time.Format(time.RFC3339), got.hasOffset, got.source, tt.want, tt.hasOffset)
+			continue
+		}
+		if tt.hasOffset && got.time.Format(time.RFC3339) != tt.want {
+			t.Errorf("%s: videoDate() lost the offset, got %s want %s", tt.name, got.time.Format(time.RFC3339), tt.want)
+		}
+	}
+}
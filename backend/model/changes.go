@@ -0,0 +1,119 @@
+package model
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/altlimit/dmedia/util"
+)
+
+type (
+	// MediaChanges are media created, modified, trashed or restored and ids permanently deleted since a token,
+	// when HasMore is set Next continues the same feed and Removed is only sent with the last page
+	MediaChanges struct {
+		Changed []Media `json:"changed"`
+		Removed []int64 `json:"removed"`
+		Next    string  `json:"next"`
+		HasMore bool    `json:"hasMore"`
+	}
+
+	// changeCursor is the feed position, since is when the feed started, start is when its first page was
+	// read and modified and id are the last media sent
+	changeCursor struct {
+		since    string
+		start    string
+		modified string
+		id       int64
+	}
+)
+
+const changesLimit = 500
+
+// changeToken encodes the db time a change feed was read at
+func changeToken(dt string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(dt))
+}
+
+// encode returns the token of a page that isn't the last
+func (c *changeCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.since + "|" + c.start + "|" + c.modified + "|" + util.I64toa(c.id)))
+}
+
+// parseChangeToken reads a token of changeToken or changeCursor.encode, now is the start of a new feed
+func parseChangeToken(token string, now string) (*changeCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.Split(string(b), "|")
+	if len(parts) == 1 {
+		parts = []string{parts[0], now, parts[0], "0"}
+	}
+	if len(parts) != 4 {
+		return nil, ErrInvalidCursor
+	}
+	for _, dt := range parts[:3] {
+		if _, err := time.Parse(util.DateTimeFormat, dt); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	id := util.Atoi64(parts[3])
+	if id < 0 {
+		return nil, ErrInvalidCursor
+	}
+	return &changeCursor{since: parts[0], start: parts[1], modified: parts[2], id: id}, nil
+}
+
+// GetMediaChanges returns changes since a token from a previous call, an empty token only returns the
+// starting token. Timestamps have a second precision so changes are inclusive of the token time
+// and clients may see the same media twice. Changes are paged by modified and id, media modified while
+// paging are sent again in a later page or by the next feed.
+func (u *User) GetMediaChanges(token string) (*MediaChanges, error) {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("GetMediaChanges getDB error: %v", err)
+	}
+	var now string
+	if err := db.Get(&now, `SELECT CURRENT_TIMESTAMP`); err != nil {
+		return nil, fmt.Errorf("GetMediaChanges now error: %v", err)
+	}
+	changes := &MediaChanges{Changed: []Media{}, Removed: []int64{}, Next: changeToken(now)}
+	if token == "" {
+		return changes, nil
+	}
+	cursor, err := parseChangeToken(token, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Select(&changes.Changed, fmt.Sprintf(`
+		SELECT *
+		FROM media
+		WHERE modified > ? OR (modified = ? AND id > ?)
+		ORDER BY modified, id
+		LIMIT %d
+	`, changesLimit+1), cursor.modified, cursor.modified, cursor.id); err != nil {
+		return nil, fmt.Errorf("GetMediaChanges select error: %v", err)
+	}
+	if len(changes.Changed) > changesLimit {
+		changes.Changed = changes.Changed[:changesLimit]
+		last := changes.Changed[changesLimit-1]
+		cursor.modified = time.Time(last.Modified).Format(util.DateTimeFormat)
+		cursor.id = last.ID
+		changes.Next = cursor.encode()
+		changes.HasMore = true
+		return changes, nil
+	}
+	// the next feed starts when this one did so media modified in the same second as a page aren't missed
+	changes.Next = changeToken(cursor.start)
+	if err := db.Select(&changes.Removed, `
+		SELECT media_id
+		FROM media_tombstone
+		WHERE deleted >= ?
+		ORDER BY deleted, media_id
+	`, cursor.since); err != nil {
+		return nil, fmt.Errorf("GetMediaChanges select tombstone error: %v", err)
+	}
+	return changes, nil
+}
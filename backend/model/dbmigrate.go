@@ -33,6 +33,69 @@ var (
 			meta TEXT NOT NULL
 		);
 		CREATE UNIQUE INDEX idx_loc_media on sync_media(location_id,media_id);
+	`,
+		`
+		CREATE TABLE album (
+			id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE album_media (
+			album_id INTEGER NOT NULL,
+			media_id INTEGER NOT NULL,
+			added DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE UNIQUE INDEX idx_album_media on album_media(album_id,media_id);
+		CREATE INDEX idx_album_media_media on album_media(media_id);
+	`,
+		`
+		CREATE VIRTUAL TABLE media_search USING fts5(
+			name, make, model, lens, codec, other,
+			tokenize = 'unicode61 remove_diacritics 2'
+		);
+	` + mediaSearchInsert + `;`,
+		`
+		CREATE INDEX idx_created on media(created, id);
+	`,
+		`
+		CREATE TABLE media_tombstone (
+			media_id INTEGER NOT NULL PRIMARY KEY,
+			deleted DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX idx_tombstone_deleted on media_tombstone(deleted);
+	`,
+		`
+		ALTER TABLE media ADD COLUMN phash INTEGER;
+	`,
+		`
+		ALTER TABLE media ADD COLUMN width INTEGER;
+		ALTER TABLE media ADD COLUMN height INTEGER;
+	`,
+		`
+		ALTER TABLE media ADD COLUMN lat REAL;
+		ALTER TABLE media ADD COLUMN lon REAL;
+		ALTER TABLE media ADD COLUMN country TEXT;
+		ALTER TABLE media ADD COLUMN city TEXT;
+		CREATE INDEX idx_place on media(country, city);
+	`,
+		`
+		ALTER TABLE media ADD COLUMN geohash TEXT;
+		CREATE INDEX idx_geo on media(lat, lon);
+	`,
+		`
+		ALTER TABLE media ADD COLUMN make TEXT;
+		ALTER TABLE media ADD COLUMN model TEXT;
+		ALTER TABLE media ADD COLUMN lens TEXT;
+		ALTER TABLE media ADD COLUMN focal_length REAL;
+		ALTER TABLE media ADD COLUMN aperture REAL;
+		ALTER TABLE media ADD COLUMN iso INTEGER;
+		ALTER TABLE media ADD COLUMN exposure TEXT;
+		ALTER TABLE media ADD COLUMN taken_at TEXT;
+		ALTER TABLE media ADD COLUMN orientation INTEGER;
+		CREATE INDEX idx_camera on media(make COLLATE NOCASE, model COLLATE NOCASE);
+		CREATE INDEX idx_lens on media(lens COLLATE NOCASE);
+		CREATE INDEX idx_taken_at on media(taken_at);
 	`,
 	}
 	dbMigrations = []string{
@@ -46,6 +109,22 @@ var (
 		);
 		CREATE UNIQUE INDEX idx_username on user(name);
 		`,
+		`CREATE TABLE job (
+			id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			jtype TEXT NOT NULL,
+			media_id INTEGER NOT NULL DEFAULT 0,
+			payload TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'queued',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			run_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX idx_job_status on job(status, run_at);
+		CREATE INDEX idx_job_user on job(user_id, jtype, media_id);
+		`,
 	}
 
 	dbMigrateTable = `
@@ -0,0 +1,162 @@
+package model
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/altlimit/dmedia/util"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// imageOrientation returns the EXIF orientation of an image file, 1 when it has none
+func imageOrientation(fPath string) int {
+	file, err := os.Open(fPath)
+	if err != nil {
+		return 1
+	}
+	defer file.Close()
+	x, err := exif.Decode(file)
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// imageSize returns the width and height of an image file as displayed after its EXIF orientation
+func imageSize(fPath string) (int, int, error) {
+	file, err := os.Open(fPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	if imageOrientation(fPath) >= 5 {
+		return cfg.Height, cfg.Width, nil
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// videoSize returns the display size of the first video stream in ffprobe info,
+// streams rotated by 90 or 270 degrees have their width and height swapped
+func videoSize(info interface{}) (int, int) {
+	m, _ := info.(map[string]interface{})
+	streams, _ := m["streams"].([]interface{})
+	for _, st := range streams {
+		s, ok := st.(map[string]interface{})
+		if !ok || s["codec_type"] != "video" {
+			continue
+		}
+		w, _ := s["width"].(float64)
+		h, _ := s["height"].(float64)
+		var rotation float64
+		// older ffprobe has it as a tag, newer in the display matrix side data
+		if tags, ok := s["tags"].(map[string]interface{}); ok {
+			if r, ok := tags["rotate"].(string); ok {
+				rotation = float64(util.Atoi64(r))
+			}
+		}
+		if sides, ok := s["side_data_list"].([]interface{}); ok {
+			for _, sd := range sides {
+				if d, ok := sd.(map[string]interface{}); ok {
+					if r, ok := d["rotation"].(float64); ok {
+						rotation = r
+					}
+				}
+			}
+		}
+		if int(math.Abs(rotation))%180 == 90 {
+			w, h = h, w
+		}
+		return int(w), int(h)
+	}
+	return 0, 0
+}
+
+// mediaSize returns the display size of a media file, 0 when it can't be read.
+// Images the decoders can't read (HEIC, AVIF) are measured from the frame ffmpeg converts for thumbnails
+func mediaSize(fPath string, cType string, meta *Meta) (int, int) {
+	if strings.Index(cType, "video/") == 0 {
+		if meta == nil {
+			return 0, 0
+		}
+		return videoSize(meta.Info)
+	}
+	src, _, err := thumbSource(fPath)
+	if err != nil {
+		return 0, 0
+	}
+	w, h, err := imageSize(src)
+	if err != nil {
+		return 0, 0
+	}
+	return w, h
+}
+
+// BackfillDimensions queues sizing media added before their display size was stored
+func (u *User) BackfillDimensions() error {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("BackfillDimensions getDB error: %v", err)
+	}
+	where := "width IS NULL"
+	if util.HasFFmpeg {
+		// images stored before ffmpeg was used for them
+		where += " OR (width = 0 AND ctype LIKE 'image/%')"
+	}
+	var ids []int64
+	if err := db.Select(&ids, `SELECT id FROM media WHERE `+where); err != nil {
+		return fmt.Errorf("BackfillDimensions select error: %v", err)
+	}
+	for _, id := range ids {
+		if err := QueueJob(u.ID, JobDimensions, id, ""); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("BackfillDimensions user %d queued %d media", u.ID, len(ids))
+	}
+	return nil
+}
+
+// sizeMedia sets the display size of a media, thumbnails of rotated images made before
+// orientation was applied are removed to be regenerated
+func (u *User) sizeMedia(id int64) error {
+	m, err := u.GetMediaByID(id)
+	if err != nil {
+		return err
+	}
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("sizeMedia getDB error: %v", err)
+	}
+	p := m.Path(u.ID)
+	w, h := mediaSize(p, m.ContentType, m.Meta)
+	if w == 0 && m.Width != nil {
+		return nil
+	}
+	if _, err := db.Exec(`UPDATE media SET width = ?, height = ?, modified = CURRENT_TIMESTAMP WHERE id = ?`, w, h, m.ID); err != nil {
+		return fmt.Errorf("sizeMedia update error: %v", err)
+	}
+	if strings.Index(m.ContentType, "image/") == 0 && imageOrientation(p) > 1 {
+		if err := os.RemoveAll(filepath.Join(filepath.Dir(p), "thumbs")); err != nil {
+			log.Printf("sizeMedia remove thumbs %d error: %v", m.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package model
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/altlimit/dmedia/util"
+)
+
+type (
+	// MediaFilter narrows down media listing, zero values are ignored
+	MediaFilter struct {
+		Deleted bool
+		// From is inclusive and To is exclusive
+		From    *time.Time
+		To      *time.Time
+		CType   string
+		Name    string
+		MinSize int64
+		MaxSize int64
+		// Country is an ISO country code and City a GeoNames city name, both ignore case
+		Country string
+		City    string
+		// Make, Model and Lens of the camera also ignore case
+		Make  string
+		Model string
+		Lens  string
+	}
+
+	// MediaCursor is the position of the last media of a keyset page
+	MediaCursor struct {
+		Created string
+		ID      int64
+	}
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+)
+
+// where builds the WHERE clause and its args, each filter is a parameterized condition
+func (f *MediaFilter) where() (string, []interface{}) {
+	if f == nil {
+		f = &MediaFilter{}
+	}
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if f.Deleted {
+		conds = append(conds, "deleted IS NOT NULL")
+	} else {
+		conds = append(conds, "deleted IS NULL")
+	}
+	if f.From != nil {
+		conds = append(conds, "created >= ?")
+		args = append(args, f.From.Format(util.DateTimeFormat))
+	}
+	if f.To != nil {
+		conds = append(conds, "created < ?")
+		args = append(args, f.To.Format(util.DateTimeFormat))
+	}
+	if f.CType != "" {
+		conds = append(conds, `ctype LIKE ? ESCAPE '\'`)
+		args = append(args, likeEscaper.Replace(f.CType)+"%")
+	}
+	if f.Name != "" {
+		conds = append(conds, `name LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(f.Name)+"%")
+	}
+	if f.MinSize > 0 {
+		conds = append(conds, "size >= ?")
+		args = append(args, f.MinSize)
+	}
+	if f.MaxSize > 0 {
+		conds = append(conds, "size <= ?")
+		args = append(args, f.MaxSize)
+	}
+	if f.Country != "" {
+		conds = append(conds, "country = ? COLLATE NOCASE")
+		args = append(args, f.Country)
+	}
+	if f.City != "" {
+		conds = append(conds, "city = ? COLLATE NOCASE")
+		args = append(args, f.City)
+	}
+	if f.Make != "" {
+		conds = append(conds, "make = ? COLLATE NOCASE")
+		args = append(args, f.Make)
+	}
+	if f.Model != "" {
+		conds = append(conds, "model = ? COLLATE NOCASE")
+		args = append(args, f.Model)
+	}
+	if f.Lens != "" {
+		conds = append(conds, "lens = ? COLLATE NOCASE")
+		args = append(args, f.Lens)
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Encode returns the opaque token given to clients
+func (c *MediaCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Created + "|" + util.I64toa(c.ID)))
+}
+
+// DecodeMediaCursor parses a token made by MediaCursor.Encode
+func DecodeMediaCursor(token string) (*MediaCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	if _, err := time.Parse(util.DateTimeFormat, parts[0]); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id := util.Atoi64(parts[1])
+	if id <= 0 {
+		return nil, ErrInvalidCursor
+	}
+	return &MediaCursor{Created: parts[0], ID: id}, nil
+}
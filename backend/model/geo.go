@@ -0,0 +1,213 @@
+package model
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/altlimit/dmedia/util"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+type (
+	// Place is a city with how many media were taken there and the newest of them as cover
+	Place struct {
+		Country string `json:"country" db:"country"`
+		City    string `json:"city" db:"city"`
+		Total   int    `json:"total" db:"total"`
+		MediaID int64  `json:"mediaId" db:"media_id"`
+	}
+
+	// GeoCluster is media close to each other on a map with their centroid and the newest as cover
+	GeoCluster struct {
+		Geohash string  `json:"geohash" db:"cell"`
+		Total   int     `json:"total" db:"total"`
+		Lat     float64 `json:"lat" db:"lat"`
+		Lon     float64 `json:"lon" db:"lon"`
+		MediaID int64   `json:"mediaId" db:"media_id"`
+	}
+
+	// BBox is a map area in degrees, West is greater than East when it crosses the antimeridian
+	BBox struct {
+		West  float64
+		South float64
+		East  float64
+		North float64
+	}
+)
+
+const (
+	// geohashPrecision of 9 is a cell of a few meters, clusters group by its prefixes
+	geohashPrecision = 9
+)
+
+var (
+	iso6709Regex = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)`)
+)
+
+// imageLatLong reads the decimal coordinates of the GPS EXIF tags of an image file
+func imageLatLong(fPath string) (float64, float64, bool) {
+	file, err := os.Open(fPath)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer file.Close()
+	x, err := exif.Decode(file)
+	if err != nil {
+		return 0, 0, false
+	}
+	lat, lon, err := x.LatLong()
+	if err != nil {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// videoLatLong reads the ISO 6709 location phones put in the video container tags
+func videoLatLong(info interface{}) (float64, float64, bool) {
+	m, _ := info.(map[string]interface{})
+	format, _ := m["format"].(map[string]interface{})
+	tags, _ := format["tags"].(map[string]interface{})
+	for _, key := range []string{"location", "com.apple.quicktime.location.ISO6709"} {
+		loc, _ := tags[key].(string)
+		if match := iso6709Regex.FindStringSubmatch(loc); match != nil {
+			lat, _ := strconv.ParseFloat(match[1], 64)
+			lon, _ := strconv.ParseFloat(match[2], 64)
+			return lat, lon, true
+		}
+	}
+	return 0, 0, false
+}
+
+// locateMedia stores the coordinates of a media with the city they're in,
+// country is left empty when it has none so it's not checked again
+func (u *User) locateMedia(id int64) error {
+	m, err := u.GetMediaByID(id)
+	if err != nil {
+		return err
+	}
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("locateMedia getDB error: %v", err)
+	}
+	var (
+		lat, lon      float64
+		ok            bool
+		country, city string
+		// nil when there's no location
+		latP, lonP interface{}
+		geohash    *string
+	)
+	if strings.Index(m.ContentType, "video/") == 0 {
+		if m.Meta != nil {
+			lat, lon, ok = videoLatLong(m.Meta.Info)
+		}
+	} else {
+		lat, lon, ok = imageLatLong(m.Path(u.ID))
+	}
+	if ok {
+		latP, lonP = lat, lon
+		gh := util.Geohash(lat, lon, geohashPrecision)
+		geohash = &gh
+		if p, found := util.ReverseGeocode(lat, lon); found {
+			country, city = p.Country, p.City
+		}
+	}
+	// modified is only bumped when the location changed so relocating doesn't flood the change feed
+	if _, err := db.Exec(`
+		UPDATE media
+		SET
+			modified = CASE WHEN lat IS ? AND lon IS ? AND country IS ? AND city IS ? THEN modified ELSE CURRENT_TIMESTAMP END,
+			lat = ?, lon = ?, geohash = ?, country = ?, city = ?
+		WHERE id = ?
+	`, latP, lonP, country, city, latP, lonP, geohash, country, city, id); err != nil {
+		return fmt.Errorf("locateMedia update error: %v", err)
+	}
+	return nil
+}
+
+// BackfillLocations queues media added before locations were stored
+// and located ones without a place when there's a dataset in case it was added since
+func (u *User) BackfillLocations() error {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("BackfillLocations getDB error: %v", err)
+	}
+	where := "country IS NULL"
+	if util.HasGeoNames() {
+		where += " OR (lat IS NOT NULL AND country = '')"
+	}
+	var ids []int64
+	if err := db.Select(&ids, `SELECT id FROM media WHERE `+where); err != nil {
+		return fmt.Errorf("BackfillLocations select error: %v", err)
+	}
+	for _, id := range ids {
+		if err := QueueJob(u.ID, JobLocate, id, ""); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("BackfillLocations user %d queued %d media", u.ID, len(ids))
+	}
+	// located before geohashes were stored
+	medias := []Media{}
+	if err := db.Select(&medias, `SELECT id, lat, lon FROM media WHERE lat IS NOT NULL AND geohash IS NULL`); err != nil {
+		return fmt.Errorf("BackfillLocations select geohash error: %v", err)
+	}
+	for _, m := range medias {
+		if _, err := db.Exec(`UPDATE media SET geohash = ? WHERE id = ?`, util.Geohash(*m.Lat, *m.Lon, geohashPrecision), m.ID); err != nil {
+			return fmt.Errorf("BackfillLocations update geohash error: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetGeoClusters groups the media matching filter in a map area by geohash cells of precision length
+func (u *User) GetGeoClusters(filter *MediaFilter, bbox BBox, precision int) ([]GeoCluster, error) {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("GetGeoClusters getDB error: %v", err)
+	}
+	where, args := filter.where()
+	where += " AND lat BETWEEN ? AND ?"
+	args = append(args, bbox.South, bbox.North)
+	if bbox.West <= bbox.East {
+		where += " AND lon BETWEEN ? AND ?"
+	} else {
+		where += " AND (lon >= ? OR lon <= ?)"
+	}
+	args = append(args, bbox.West, bbox.East)
+	clusters := []GeoCluster{}
+	if err := db.Select(&clusters, fmt.Sprintf(`
+		SELECT substr(geohash, 1, %d) AS cell, COUNT(1) AS total, AVG(lat) AS lat, AVG(lon) AS lon, MAX(id) AS media_id
+		FROM media
+		%s AND geohash IS NOT NULL
+		GROUP BY cell
+		ORDER BY total DESC
+	`, precision, where), args...); err != nil {
+		return nil, fmt.Errorf("GetGeoClusters select error: %v", err)
+	}
+	return clusters, nil
+}
+
+// GetPlaces lists the cities media not in trash were taken in, most media first
+func (u *User) GetPlaces() ([]Place, error) {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("GetPlaces getDB error: %v", err)
+	}
+	places := []Place{}
+	if err := db.Select(&places, `
+		SELECT country, city, COUNT(1) AS total, MAX(id) AS media_id
+		FROM media
+		WHERE deleted IS NULL AND country != ''
+		GROUP BY country, city
+		ORDER BY total DESC, country, city
+	`); err != nil {
+		return nil, fmt.Errorf("GetPlaces select error: %v", err)
+	}
+	return places, nil
+}
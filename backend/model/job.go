@@ -0,0 +1,383 @@
+package model
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/altlimit/dmedia/util"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	JobProbe      = "probe"
+	JobPHash      = "phash"
+	JobThumbnail  = "thumbnail"
+	JobTranscode  = "transcode"
+	JobLocate     = "locate"
+	JobUploadDir  = "upload_dir"
+	JobDimensions = "dimensions"
+	JobPhotoInfo  = "photo_info"
+	// JobSync runs the sync locations of a user, it's registered by the sync package
+	JobSync = "sync"
+
+	jobMaxAttempts = 5
+	jobPoll        = time.Second * 5
+)
+
+type (
+	// Job is a unit of background work stored in main.db so it survives restarts,
+	// payload is free form data for jobs that aren't about a single media
+	Job struct {
+		ID       int64    `json:"id" db:"id"`
+		UserID   int64    `json:"-" db:"user_id"`
+		Type     string   `json:"type" db:"jtype"`
+		MediaID  int64    `json:"mediaId" db:"media_id"`
+		Payload  string   `json:"payload,omitempty" db:"payload"`
+		Status   string   `json:"status" db:"status"`
+		Attempts int      `json:"attempts" db:"attempts"`
+		Error    string   `json:"error,omitempty" db:"error"`
+		RunAt    DateTime `json:"runAt" db:"run_at"`
+		Created  DateTime `json:"created" db:"created"`
+		Modified DateTime `json:"modified" db:"modified"`
+	}
+
+	// JobHandler runs a job, returning an error retries it with backoff
+	JobHandler func(u *User, j *Job) error
+
+	// permanentError fails a job without retrying it, for errors that would happen again
+	permanentError struct {
+		err error
+	}
+)
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+var (
+	jobHandlers = map[string]JobHandler{
+		JobProbe:      jobProbe,
+		JobPHash:      jobPHash,
+		JobThumbnail:  jobThumbnail,
+		JobTranscode:  jobTranscode,
+		JobLocate:     jobLocate,
+		JobDimensions: jobDimensions,
+		JobPhotoInfo:  jobPhotoInfo,
+	}
+	jobNotify = make(chan struct{}, 1)
+	// jobLock serializes claiming so workers never pick the same job
+	jobLock      sync.Mutex
+	jobLastClaim = make(map[int64]time.Time)
+)
+
+// RegisterJob adds a handler for a job type defined outside of model
+func RegisterJob(jtype string, h JobHandler) {
+	jobHandlers[jtype] = h
+}
+
+// QueueJob adds a job unless the same one is already waiting or running
+func QueueJob(userID int64, jtype string, mediaID int64, payload string) error {
+	db, err := getDB(0)
+	if err != nil {
+		return fmt.Errorf("QueueJob getDB error: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO job(user_id, jtype, media_id, payload)
+		SELECT ?, ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM job
+			WHERE user_id = ? AND jtype = ? AND media_id = ? AND payload = ? AND status IN (?, ?)
+		)`, userID, jtype, mediaID, payload, userID, jtype, mediaID, payload, JobQueued, JobRunning); err != nil {
+		return fmt.Errorf("QueueJob insert error: %v", err)
+	}
+	wakeJobWorker()
+	return nil
+}
+
+func wakeJobWorker() {
+	select {
+	case jobNotify <- struct{}{}:
+	default:
+	}
+}
+
+// StartJobWorkers requeues jobs interrupted by a restart and runs workers jobs at a time
+func StartJobWorkers(workers int) {
+	db, err := getDB(0)
+	if err != nil {
+		log.Printf("StartJobWorkers getDB error: %v", err)
+		return
+	}
+	if _, err := db.Exec(`UPDATE job SET status = ? WHERE status = ?`, JobQueued, JobRunning); err != nil {
+		log.Printf("StartJobWorkers requeue error: %v", err)
+	}
+	for i := 0; i < workers; i++ {
+		go jobWorker()
+	}
+	log.Printf("Started %d job workers", workers)
+	for {
+		CleanJobs()
+		time.Sleep(time.Hour)
+	}
+}
+
+func jobWorker() {
+	for {
+		j, err := claimJob()
+		if err != nil {
+			log.Printf("jobWorker claim error: %v", err)
+		}
+		if j == nil {
+			select {
+			case <-jobNotify:
+			case <-time.After(jobPoll):
+			}
+			continue
+		}
+		// there may be more for idle workers
+		wakeJobWorker()
+		runJob(j)
+	}
+}
+
+// claimJob marks the next due job as running, picking the user with the fewest
+// running jobs then the one that waited the longest so a big import doesn't starve others
+func claimJob() (*Job, error) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	db, err := getDB(0)
+	if err != nil {
+		return nil, fmt.Errorf("claimJob getDB error: %v", err)
+	}
+	users := []struct {
+		UserID  int64 `db:"user_id"`
+		Running int   `db:"running"`
+	}{}
+	if err := db.Select(&users, `
+		SELECT user_id, (SELECT COUNT(1) FROM job r WHERE r.user_id = job.user_id AND r.status = ?) AS running
+		FROM job
+		WHERE status = ? AND run_at <= CURRENT_TIMESTAMP
+		GROUP BY user_id
+	`, JobRunning, JobQueued); err != nil {
+		return nil, fmt.Errorf("claimJob select users error: %v", err)
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	next := users[0]
+	for _, u := range users[1:] {
+		if u.Running < next.Running || (u.Running == next.Running && jobLastClaim[u.UserID].Before(jobLastClaim[next.UserID])) {
+			next = u
+		}
+	}
+	j := &Job{}
+	if err := db.Get(j, `
+		SELECT *
+		FROM job
+		WHERE user_id = ? AND status = ? AND run_at <= CURRENT_TIMESTAMP
+		ORDER BY run_at, id
+		LIMIT 1
+	`, next.UserID, JobQueued); err != nil {
+		return nil, fmt.Errorf("claimJob select job error: %v", err)
+	}
+	if _, err := db.Exec(`
+		UPDATE job SET status = ?, attempts = attempts + 1, modified = CURRENT_TIMESTAMP
+		WHERE id = ?`, JobRunning, j.ID); err != nil {
+		return nil, fmt.Errorf("claimJob update error: %v", err)
+	}
+	j.Status = JobRunning
+	j.Attempts++
+	jobLastClaim[next.UserID] = time.Now()
+	return j, nil
+}
+
+func runJob(j *Job) {
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		h, ok := jobHandlers[j.Type]
+		if !ok {
+			return ErrNotSupported
+		}
+		return h(&User{ID: j.UserID}, j)
+	}()
+	db, dbErr := getDB(0)
+	if dbErr != nil {
+		log.Printf("runJob getDB error: %v", dbErr)
+		return
+	}
+	_, permanent := err.(*permanentError)
+	retrying := err != nil && !permanent && j.Attempts < jobMaxAttempts && err != ErrNotSupported
+	if err == nil {
+		_, dbErr = db.Exec(`UPDATE job SET status = ?, error = '', modified = CURRENT_TIMESTAMP WHERE id = ?`, JobDone, j.ID)
+	} else if retrying {
+		// 30s, 1m, 2m, 4m between attempts
+		backoff := 30 * (1 << uint(j.Attempts-1))
+		log.Printf("runJob %s %d attempt %d error: %v, retrying in %ds", j.Type, j.ID, j.Attempts, err, backoff)
+		_, dbErr = db.Exec(`
+			UPDATE job SET status = ?, error = ?, run_at = datetime('now', ?), modified = CURRENT_TIMESTAMP
+			WHERE id = ?`, JobQueued, err.Error(), fmt.Sprintf("+%d seconds", backoff), j.ID)
+	} else {
+		log.Printf("runJob %s %d failed: %v", j.Type, j.ID, err)
+		_, dbErr = db.Exec(`UPDATE job SET status = ?, error = ?, modified = CURRENT_TIMESTAMP WHERE id = ?`, JobFailed, err.Error(), j.ID)
+	}
+	if dbErr != nil {
+		log.Printf("runJob update %d error: %v", j.ID, dbErr)
+		return
+	}
+	// media are synced once probed since the probe can move them, it's queued after
+	// the probe is finished so the sync doesn't skip it as still probing
+	if j.Type == JobProbe && !retrying {
+		if err := QueueJob(j.UserID, JobSync, 0, ""); err != nil {
+			log.Printf("runJob queue %s error: %v", JobSync, err)
+		}
+	}
+}
+
+// CleanJobs removes finished jobs after a day and failed ones after a week
+func CleanJobs() {
+	db, err := getDB(0)
+	if err != nil {
+		log.Printf("CleanJobs getDB error: %v", err)
+		return
+	}
+	if _, err := db.Exec(`
+		DELETE FROM job
+		WHERE (status = ? AND modified < datetime('now', '-1 day'))
+		OR (status = ? AND modified < datetime('now', '-7 days'))
+	`, JobDone, JobFailed); err != nil {
+		log.Printf("CleanJobs delete error: %v", err)
+	}
+}
+
+// GetJobs lists the jobs of a user newest first, status is optional
+func (u *User) GetJobs(status string, page int, limit int) ([]Job, int, error) {
+	db, err := getDB(0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("GetJobs getDB error: %v", err)
+	}
+	where := "WHERE user_id = ?"
+	args := []interface{}{u.ID}
+	if status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+	jobs := []Job{}
+	if err := db.Select(&jobs, fmt.Sprintf(`
+		SELECT *
+		FROM job
+		%s
+		ORDER BY id DESC
+		LIMIT %d
+		OFFSET %d
+	`, where, limit, (limit*page)-limit), args...); err != nil {
+		return nil, 0, fmt.Errorf("GetJobs select error: %v", err)
+	}
+	var total int
+	if err := db.Get(&total, fmt.Sprintf(`SELECT COUNT(1) FROM job %s`, where), args...); err != nil {
+		return nil, 0, fmt.Errorf("GetJobs select count error: %v", err)
+	}
+	return jobs, total, nil
+}
+
+// GetJobStats counts the jobs of a user by type then status
+func (u *User) GetJobStats() (map[string]map[string]int, error) {
+	db, err := getDB(0)
+	if err != nil {
+		return nil, fmt.Errorf("GetJobStats getDB error: %v", err)
+	}
+	rows := []struct {
+		Type   string `db:"jtype"`
+		Status string `db:"status"`
+		Total  int    `db:"total"`
+	}{}
+	if err := db.Select(&rows, `
+		SELECT jtype, status, COUNT(1) AS total
+		FROM job
+		WHERE user_id = ?
+		GROUP BY jtype, status
+	`, u.ID); err != nil {
+		return nil, fmt.Errorf("GetJobStats select error: %v", err)
+	}
+	stats := make(map[string]map[string]int)
+	for _, r := range rows {
+		if stats[r.Type] == nil {
+			stats[r.Type] = make(map[string]int)
+		}
+		stats[r.Type][r.Status] = r.Total
+	}
+	return stats, nil
+}
+
+// media jobs skip media deleted since they were queued
+
+func jobProbe(u *User, j *Job) error {
+	if err := u.probeMedia(j.MediaID); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func jobPHash(u *User, j *Job) error {
+	if err := u.hashMedia(j.MediaID); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func jobThumbnail(u *User, j *Job) error {
+	m, err := u.GetMediaByID(j.MediaID)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p := m.Path(u.ID)
+	for _, size := range ThumbSizes {
+		if _, err := Thumbnail(p, size, ThumbJPEG); err != nil {
+			// videos and images go can't decode need ffmpeg so retrying won't help without it
+			if !util.HasFFmpeg {
+				return &permanentError{err: err}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func jobDimensions(u *User, j *Job) error {
+	if err := u.sizeMedia(j.MediaID); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func jobPhotoInfo(u *User, j *Job) error {
+	if err := u.readPhotoInfo(j.MediaID); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func jobLocate(u *User, j *Job) error {
+	if err := u.locateMedia(j.MediaID); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func jobTranscode(u *User, j *Job) error {
+	if err := u.transcode(j.MediaID); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
@@ -19,6 +19,7 @@ var (
 
 	ErrNotFound     = fmt.Errorf("not found")
 	ErrNotSupported = fmt.Errorf("not supported")
+	ErrTooLarge     = fmt.Errorf("content too large")
 )
 
 type (
@@ -108,11 +109,38 @@ func getDB(userID int64) (*sqlx.DB, error) {
 			if err != nil {
 				return nil, fmt.Errorf("getDB db.Exec 2 error: %v", err)
 			}
-		}
-		if _, err := db.Exec(`UPDATE migrations SET version = ?`, tdb); err != nil {
-			return nil, fmt.Errorf("getDB db.Exec 3 error: %v", err)
+			// keep track of each step so a failed migration is not re-applied from the start
+			if _, err := db.Exec(`UPDATE migrations SET version = ?`, i+1); err != nil {
+				return nil, fmt.Errorf("getDB db.Exec 3 error: %v", err)
+			}
 		}
 		log.Printf("Migrated db to %d", tdb)
 	}
 	return db, nil
 }
+
+// Backfill fills in data of existing media that newer versions compute at ingest
+func Backfill() {
+	users, err := GetUsers()
+	if err != nil {
+		log.Printf("Backfill get users error: %v", err)
+		return
+	}
+	for _, u := range users {
+		if err := u.BackfillPHash(); err != nil {
+			log.Printf("Backfill user %d error: %v", u.ID, err)
+		}
+		if err := u.BackfillDimensions(); err != nil {
+			log.Printf("Backfill user %d error: %v", u.ID, err)
+		}
+		if err := u.QueueTranscodes(); err != nil {
+			log.Printf("Backfill user %d error: %v", u.ID, err)
+		}
+		if err := u.BackfillLocations(); err != nil {
+			log.Printf("Backfill user %d error: %v", u.ID, err)
+		}
+		if err := u.BackfillPhotoInfo(); err != nil {
+			log.Printf("Backfill user %d error: %v", u.ID, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package model
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/altlimit/dmedia/util"
+)
+
+type (
+	// bkNode is a BK-tree keyed by hamming distance for near-duplicate lookups
+	bkNode struct {
+		hash     uint64
+		ids      []int64
+		children map[int]*bkNode
+	}
+)
+
+func (n *bkNode) add(hash uint64, id int64) {
+	for {
+		d := util.HammingDistance(n.hash, hash)
+		if d == 0 {
+			n.ids = append(n.ids, id)
+			return
+		}
+		child, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[int]*bkNode)
+			}
+			n.children[d] = &bkNode{hash: hash, ids: []int64{id}}
+			return
+		}
+		n = child
+	}
+}
+
+func (n *bkNode) find(hash uint64, distance int, found func(ids []int64)) {
+	d := util.HammingDistance(n.hash, hash)
+	if d <= distance {
+		found(n.ids)
+	}
+	for cd, child := range n.children {
+		if cd >= d-distance && cd <= d+distance {
+			child.find(hash, distance, found)
+		}
+	}
+}
+
+// imageHash returns the perceptual hash of an image file, 0 when it can't be decoded
+// which is also what's stored so backfill doesn't retry it
+func imageHash(path string) int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("imageHash open %s error: %v", path, err)
+		return 0
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0
+	}
+	return int64(util.DHash(img))
+}
+
+// hashMedia stores the perceptual hash of an image
+func (u *User) hashMedia(id int64) error {
+	m, err := u.GetMediaByID(id)
+	if err != nil {
+		return err
+	}
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("hashMedia getDB error: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE media SET phash = ? WHERE id = ?`, imageHash(m.Path(u.ID)), id); err != nil {
+		return fmt.Errorf("hashMedia update error: %v", err)
+	}
+	return nil
+}
+
+// BackfillPHash queues hashing of images added before perceptual hashes existed
+func (u *User) BackfillPHash() error {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("BackfillPHash getDB error: %v", err)
+	}
+	var ids []int64
+	if err := db.Select(&ids, `SELECT id FROM media WHERE phash IS NULL AND ctype LIKE 'image/%'`); err != nil {
+		return fmt.Errorf("BackfillPHash select error: %v", err)
+	}
+	for _, id := range ids {
+		if err := QueueJob(u.ID, JobPHash, id, ""); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("BackfillPHash user %d queued %d images", u.ID, len(ids))
+	}
+	return nil
+}
+
+// GetSimilarMedia groups images not in trash whose perceptual hashes are within distance bits,
+// groups are sorted by their newest media
+func (u *User) GetSimilarMedia(distance int) ([][]Media, error) {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("GetSimilarMedia getDB error: %v", err)
+	}
+	hashes := []Media{}
+	if err := db.Select(&hashes, `
+		SELECT id, phash
+		FROM media
+		WHERE deleted IS NULL AND phash IS NOT NULL AND phash != 0
+	`); err != nil {
+		return nil, fmt.Errorf("GetSimilarMedia select error: %v", err)
+	}
+	// union find over ids close to each other
+	parent := make(map[int64]int64)
+	var root func(id int64) int64
+	root = func(id int64) int64 {
+		for parent[id] != id {
+			parent[id] = parent[parent[id]]
+			id = parent[id]
+		}
+		return id
+	}
+	var tree *bkNode
+	for _, m := range hashes {
+		parent[m.ID] = m.ID
+		if tree == nil {
+			tree = &bkNode{hash: uint64(*m.PHash), ids: []int64{m.ID}}
+			continue
+		}
+		tree.add(uint64(*m.PHash), m.ID)
+	}
+	for _, m := range hashes {
+		tree.find(uint64(*m.PHash), distance, func(ids []int64) {
+			for _, id := range ids {
+				a, b := root(m.ID), root(id)
+				if a != b {
+					parent[a] = b
+				}
+			}
+		})
+	}
+	groupIDs := make(map[int64][]int64)
+	var ids []int64
+	for _, m := range hashes {
+		r := root(m.ID)
+		groupIDs[r] = append(groupIDs[r], m.ID)
+	}
+	for _, g := range groupIDs {
+		if len(g) > 1 {
+			ids = append(ids, g...)
+		}
+	}
+	if len(ids) == 0 {
+		return [][]Media{}, nil
+	}
+	medias := []Media{}
+	if err := db.Select(&medias, fmt.Sprintf(`
+		SELECT *
+		FROM media
+		WHERE id IN (%s)
+		ORDER BY created DESC, id DESC
+	`, strings.Join(util.Int64ToStrings(ids), ","))); err != nil {
+		return nil, fmt.Errorf("GetSimilarMedia select media error: %v", err)
+	}
+	groups := [][]Media{}
+	index := make(map[int64]int)
+	for _, m := range medias {
+		r := root(m.ID)
+		i, ok := index[r]
+		if !ok {
+			i = len(groups)
+			index[r] = i
+			groups = append(groups, []Media{})
+		}
+		groups[i] = append(groups[i], m)
+	}
+	return groups, nil
+}
@@ -0,0 +1,233 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+const (
+	// goexif doesn't know the EXIF 2.31 offset tags, offsetParser loads them
+	OffsetTime          exif.FieldName = "OffsetTime"
+	OffsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"
+	OffsetTimeDigitized exif.FieldName = "OffsetTimeDigitized"
+
+	exifTimeLayout = "2006:01:02 15:04:05"
+	// takenAtFormat is the local capture time, followed by its offset when known
+	takenAtFormat = "2006-01-02T15:04:05"
+)
+
+type (
+	// PhotoInfo is the typed metadata of a media stored in its own columns,
+	// fields are nil when the media doesn't have them
+	PhotoInfo struct {
+		Make        *string  `json:"make" db:"make"`
+		Model       *string  `json:"model" db:"model"`
+		Lens        *string  `json:"lens" db:"lens"`
+		FocalLength *float64 `json:"focalLength" db:"focal_length"`
+		Aperture    *float64 `json:"aperture" db:"aperture"`
+		ISO         *int     `json:"iso" db:"iso"`
+		// Exposure is in seconds as shown by cameras like 1/250 or 2
+		Exposure *string  `json:"exposure" db:"exposure"`
+		TakenAt  *string  `json:"takenAt" db:"taken_at"`
+		Lat      *float64 `json:"lat" db:"lat"`
+		Lon      *float64 `json:"lon" db:"lon"`
+		// Width and Height are as displayed after Orientation
+		Width       *int `json:"width" db:"width"`
+		Height      *int `json:"height" db:"height"`
+		Orientation *int `json:"orientation" db:"orientation"`
+	}
+
+	offsetParser struct{}
+)
+
+func init() {
+	exif.RegisterParsers(&offsetParser{})
+}
+
+// Parse loads the offset tags from the EXIF sub-IFD
+func (p *offsetParser) Parse(x *exif.Exif) error {
+	tag, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return nil
+	}
+	offset, err := tag.Int64(0)
+	if err != nil {
+		return nil
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, 0); err != nil {
+		return nil
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return nil
+	}
+	x.LoadTags(dir, map[uint16]exif.FieldName{0x9010: OffsetTime, 0x9011: OffsetTimeOriginal, 0x9012: OffsetTimeDigitized}, false)
+	return nil
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) *string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return nil
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return nil
+	}
+	s = strings.TrimSpace(strings.TrimRight(s, "\x00"))
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func exifRat(x *exif.Exif, name exif.FieldName) (int64, int64, bool) {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0, 0, false
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || num <= 0 || den <= 0 {
+		return 0, 0, false
+	}
+	return num, den, true
+}
+
+// exifDate returns when a photo was taken in its local time, with the offset of its OffsetTime tags
+// when it has them. Scanners often only have the digitized time which is before the file's DateTime
+func exifDate(x *exif.Exif) *captureDate {
+	for _, names := range [][2]exif.FieldName{
+		{exif.DateTimeOriginal, OffsetTimeOriginal},
+		{exif.DateTimeDigitized, OffsetTimeDigitized},
+		{exif.DateTime, OffsetTime},
+	} {
+		dts := exifString(x, names[0])
+		if dts == nil {
+			continue
+		}
+		if offset := exifString(x, names[1]); offset != nil {
+			if t, err := time.Parse(exifTimeLayout+"-07:00", *dts+*offset); err == nil {
+				return &captureDate{time: t, hasOffset: true, source: DateExif}
+			}
+		}
+		if t, err := time.Parse(exifTimeLayout, *dts); err == nil {
+			return &captureDate{time: t, source: DateExif}
+		}
+	}
+	return nil
+}
+
+// exifPhotoInfo reads the typed fields of decoded EXIF, the size is from mediaSize
+func exifPhotoInfo(x *exif.Exif) PhotoInfo {
+	info := PhotoInfo{
+		Make:  exifString(x, exif.Make),
+		Model: exifString(x, exif.Model),
+		Lens:  exifString(x, exif.LensModel),
+	}
+	if num, den, ok := exifRat(x, exif.FocalLength); ok {
+		f := math.Round(float64(num)/float64(den)*10) / 10
+		info.FocalLength = &f
+	}
+	if num, den, ok := exifRat(x, exif.FNumber); ok {
+		f := math.Round(float64(num)/float64(den)*10) / 10
+		info.Aperture = &f
+	}
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := tag.Int(0); err == nil && iso > 0 {
+			info.ISO = &iso
+		}
+	}
+	if num, den, ok := exifRat(x, exif.ExposureTime); ok {
+		var e string
+		if num < den {
+			e = fmt.Sprintf("1/%d", int64(math.Round(float64(den)/float64(num))))
+		} else {
+			e = fmt.Sprintf("%g", math.Round(float64(num)/float64(den)*10)/10)
+		}
+		info.Exposure = &e
+	}
+	if d := exifDate(x); d != nil {
+		info.TakenAt = d.takenAt()
+	}
+	if lat, lon, err := x.LatLong(); err == nil {
+		info.Lat, info.Lon = &lat, &lon
+	}
+	o := 1
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if v, err := tag.Int(0); err == nil && v >= 1 && v <= 8 {
+			o = v
+		}
+	}
+	info.Orientation = &o
+	return info
+}
+
+// imagePhotoInfo reads the photo info and EXIF date of an image file,
+// only orientation is set without EXIF
+func imagePhotoInfo(fPath string) (PhotoInfo, *captureDate) {
+	o := 1
+	info := PhotoInfo{Orientation: &o}
+	file, err := os.Open(fPath)
+	if err != nil {
+		return info, nil
+	}
+	defer file.Close()
+	x, err := exif.Decode(file)
+	if err != nil {
+		return info, nil
+	}
+	return exifPhotoInfo(x), exifDate(x)
+}
+
+// BackfillPhotoInfo queues reading the photo info of images added before it was stored
+func (u *User) BackfillPhotoInfo() error {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("BackfillPhotoInfo getDB error: %v", err)
+	}
+	var ids []int64
+	if err := db.Select(&ids, `SELECT id FROM media WHERE orientation IS NULL AND ctype LIKE 'image/%'`); err != nil {
+		return fmt.Errorf("BackfillPhotoInfo select error: %v", err)
+	}
+	for _, id := range ids {
+		if err := QueueJob(u.ID, JobPhotoInfo, id, ""); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("BackfillPhotoInfo user %d queued %d media", u.ID, len(ids))
+	}
+	return nil
+}
+
+// readPhotoInfo sets the photo info of an image, orientation is always set once it's read
+func (u *User) readPhotoInfo(id int64) error {
+	m, err := u.GetMediaByID(id)
+	if err != nil {
+		return err
+	}
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("readPhotoInfo getDB error: %v", err)
+	}
+	info, _ := imagePhotoInfo(m.Path(u.ID))
+	if _, err := db.Exec(`
+		UPDATE media
+		SET
+			make = ?, model = ?, lens = ?, focal_length = ?, aperture = ?, iso = ?, exposure = ?, taken_at = ?, orientation = ?,
+			modified = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, info.Make, info.Model, info.Lens, info.FocalLength, info.Aperture, info.ISO, info.Exposure, info.TakenAt, info.Orientation, m.ID); err != nil {
+		return fmt.Errorf("readPhotoInfo update error: %v", err)
+	}
+	return nil
+}
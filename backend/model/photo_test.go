@@ -0,0 +1,113 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// tiffExif builds little endian TIFF EXIF with ascii tags in IFD0 and the EXIF sub-IFD
+func tiffExif(t *testing.T, ifd0, sub map[uint16]string) *exif.Exif {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	b.WriteString("II*\x00")
+	binary.Write(&b, le, uint32(8))
+	// writeIFD lays out the entries at off followed by their values, ptr adds a LONG entry
+	writeIFD := func(off uint32, tags map[uint16]string, ptr uint16, ptrVal uint32) []byte {
+		var ids []int
+		for id := range tags {
+			ids = append(ids, int(id))
+		}
+		if ptr != 0 {
+			ids = append(ids, int(ptr))
+		}
+		sort.Ints(ids)
+		var dir, vals bytes.Buffer
+		valOff := off + 2 + uint32(len(ids))*12 + 4
+		binary.Write(&dir, le, uint16(len(ids)))
+		for _, id := range ids {
+			binary.Write(&dir, le, uint16(id))
+			if uint16(id) == ptr {
+				binary.Write(&dir, le, uint16(4))
+				binary.Write(&dir, le, uint32(1))
+				binary.Write(&dir, le, ptrVal)
+				continue
+			}
+			v := tags[uint16(id)] + "\x00"
+			binary.Write(&dir, le, uint16(2))
+			binary.Write(&dir, le, uint32(len(v)))
+			if len(v) <= 4 {
+				var inline [4]byte
+				copy(inline[:], v)
+				dir.Write(inline[:])
+				continue
+			}
+			binary.Write(&dir, le, valOff+uint32(vals.Len()))
+			vals.WriteString(v)
+			if vals.Len()%2 == 1 {
+				vals.WriteByte(0)
+			}
+		}
+		binary.Write(&dir, le, uint32(0))
+		return append(dir.Bytes(), vals.Bytes()...)
+	}
+	// IFD0 size doesn't depend on the pointer value so it's laid out twice
+	first := writeIFD(8, ifd0, 0x8769, 0)
+	subOff := 8 + uint32(len(first))
+	b.Write(writeIFD(8, ifd0, 0x8769, subOff))
+	b.Write(writeIFD(subOff, sub, 0, 0))
+	x, err := exif.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+func TestExifDate(t *testing.T) {
+	tests := []struct {
+		name      string
+		ifd0, sub map[uint16]string
+		want      string
+		hasOffset bool
+	}{
+		{"original with offset", map[uint16]string{0x0132: "2000:01:01 00:00:00"},
+			map[uint16]string{0x9003: "2021:05:06 07:08:09", 0x9011: "+08:00", 0x9004: "2020:01:01 00:00:00"},
+			"2021-05-06T07:08:09+08:00", true},
+		{"original local", map[uint16]string{0x0132: "2000:01:01 00:00:00"},
+			map[uint16]string{0x9003: "2021:05:06 07:08:09", 0x9010: "+01:00"},
+			"2021-05-06T07:08:09Z", false},
+		{"digitized before datetime", map[uint16]string{0x0132: "2000:01:01 00:00:00"},
+			map[uint16]string{0x9004: "1999:02:03 04:05:06", 0x9012: "-05:00", 0x9010: "+01:00"},
+			"1999-02-03T04:05:06-05:00", true},
+		{"digitized local", map[uint16]string{0x0132: "2000:01:01 00:00:00"},
+			map[uint16]string{0x9004: "1999:02:03 04:05:06"},
+			"1999-02-03T04:05:06Z", false},
+		{"datetime", map[uint16]string{0x0132: "2000:01:01 10:11:12"},
+			map[uint16]string{0x9010: "+09:00"},
+			"2000-01-01T10:11:12+09:00", true},
+		{"invalid original falls through", map[uint16]string{0x0132: "2000:01:01 10:11:12"},
+			map[uint16]string{0x9003: "0000:00:00 00:00:00"},
+			"2000-01-01T10:11:12Z", false},
+		{"no dates", nil, map[uint16]string{0x9011: "+08:00"}, "", false},
+	}
+	for _, tt := range tests {
+		got := exifDate(tiffExif(t, tt.ifd0, tt.sub))
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("%s: exifDate() = %+v, want nil", tt.name, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: exifDate() = nil, want %s", tt.name, tt.want)
+			continue
+		}
+		if s := got.time.Format(time.RFC3339); s != tt.want || got.hasOffset != tt.hasOffset || got.source != DateExif {
+			t.Errorf("%s: exifDate() = %s %v %s, want %s %v", tt.name, s, got.hasOffset, got.source, tt.want, tt.hasOffset)
+		}
+	}
+}
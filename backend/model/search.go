@@ -0,0 +1,77 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// mediaSearchInsert indexes media rows into media_search, it's used as is by the
+// migration backfill and with a WHERE id = ? by AddMedia.
+// other holds every remaining text value from exif tags and the ffprobe format.
+const mediaSearchInsert = `
+		INSERT INTO media_search(rowid, name, make, model, lens, codec, other)
+		SELECT id, name,
+			json_extract(meta, '$.exif.Make'),
+			json_extract(meta, '$.exif.Model'),
+			json_extract(meta, '$.exif.LensModel'),
+			(SELECT group_concat(json_extract(value, '$.codec_name'), ' ')
+				FROM json_each(meta, '$.info.streams')),
+			(SELECT group_concat(value, ' ') FROM (
+				SELECT value FROM json_each(meta, '$.exif')
+				WHERE type = 'text' AND key NOT IN ('Make', 'Model', 'LensModel', 'MakerNote')
+				UNION ALL
+				SELECT json_extract(meta, '$.info.format.format_long_name')
+				UNION ALL
+				SELECT value FROM json_each(meta, '$.info.format.tags') WHERE type = 'text'
+			))
+		FROM (
+			SELECT id, name, CASE WHEN json_valid(meta) THEN meta ELSE '{}' END AS meta
+			FROM media
+		)`
+
+// ftsQuery turns user input into an fts5 query where every word is a prefix match
+func ftsQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for i, w := range words {
+		words[i] = `"` + w + `"*`
+	}
+	return strings.Join(words, " ")
+}
+
+// SearchMedia ranks media that are not in trash across name, camera, lens, codec and other metadata
+func (u *User) SearchMedia(q string, page int, limit int) ([]Media, int, error) {
+	query := ftsQuery(q)
+	if query == "" {
+		return []Media{}, 0, nil
+	}
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("SearchMedia getDB error: %v", err)
+	}
+	allMedia := []Media{}
+	err = db.Select(&allMedia, fmt.Sprintf(`
+		SELECT m.*
+		FROM media_search s
+		JOIN media m ON m.id = s.rowid
+		WHERE media_search MATCH ? AND m.deleted IS NULL
+		ORDER BY bm25(media_search, 10.0, 5.0, 5.0, 5.0, 3.0, 1.0), m.created DESC
+		LIMIT %d
+		OFFSET %d
+	`, limit, (limit*page)-limit), query)
+	if err != nil {
+		return nil, 0, fmt.Errorf("SearchMedia db select error: %v", err)
+	}
+	var total int
+	if err := db.Get(&total, `
+		SELECT COUNT(1)
+		FROM media_search s
+		JOIN media m ON m.id = s.rowid
+		WHERE media_search MATCH ? AND m.deleted IS NULL
+	`, query); err != nil {
+		return nil, 0, fmt.Errorf("SearchMedia select count error %v", err)
+	}
+	return allMedia, total, nil
+}
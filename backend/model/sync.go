@@ -140,6 +140,19 @@ func GetMediaToSync(userID int64, loc *SyncLocation) ([]Media, []SyncMedia, erro
 		) ORDER BY created`, loc.ID); err != nil {
 			return nil, nil, fmt.Errorf("GetMediaToSync select error %v", err)
 		}
+		// media waiting for their probe can still move to their capture date,
+		// they're synced by the sync job queued after it
+		probing, err := probingMedia(userID)
+		if err != nil {
+			return nil, nil, err
+		}
+		ready := medias[:0]
+		for _, m := range medias {
+			if !probing[m.ID] {
+				ready = append(ready, m)
+			}
+		}
+		medias = ready
 		if err := db.Select(&toDelete, `SELECT * FROM sync_media
 			WHERE
 				location_id = $1 AND
@@ -192,3 +205,21 @@ func UpdateSyncMedia(userID int64, loc *SyncLocation, syncMedias []SyncMedia, de
 	}
 	return nil
 }
+
+// probingMedia returns the ids of media with a probe job that hasn't finished
+func probingMedia(userID int64) (map[int64]bool, error) {
+	db, err := getDB(0)
+	if err != nil {
+		return nil, fmt.Errorf("probingMedia getDB error %v", err)
+	}
+	var ids []int64
+	if err := db.Select(&ids, `SELECT media_id FROM job WHERE user_id = ? AND jtype = ? AND status IN (?, ?)`,
+		userID, JobProbe, JobQueued, JobRunning); err != nil {
+		return nil, fmt.Errorf("probingMedia select error %v", err)
+	}
+	probing := make(map[int64]bool)
+	for _, id := range ids {
+		probing[id] = true
+	}
+	return probing, nil
+}
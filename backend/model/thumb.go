@@ -0,0 +1,167 @@
+package model
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/altlimit/dmedia/util"
+	resizer "github.com/nfnt/resize"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	ThumbJPEG = "jpg"
+	ThumbWebP = "webp"
+)
+
+var (
+	// ThumbSizes are the widths thumbnails are stored at, requested sizes snap to these
+	ThumbSizes = []int{128, 256, 512, 1024, 2048}
+
+	thumbLocks sync.Map
+)
+
+// ThumbSize snaps a requested width to the smallest standard size that fits it
+func ThumbSize(size int) int {
+	for _, s := range ThumbSizes {
+		if size <= s {
+			return s
+		}
+	}
+	return ThumbSizes[len(ThumbSizes)-1]
+}
+
+// ThumbPath is where the thumbnail of the media at path p is stored for a standard size and format
+func ThumbPath(p string, size int, format string) string {
+	return filepath.Join(filepath.Dir(p), "thumbs", fmt.Sprintf("%d.%s", size, format))
+}
+
+// Thumbnail returns the path of the thumbnail of the media at p, generating it when missing.
+// Videos and images the decoders can't read (HEIC, AVIF) are converted with ffmpeg first,
+// WebP thumbnails are encoded with ffmpeg from the JPEG of the same size and aren't supported without it.
+func Thumbnail(p string, size int, format string) (string, error) {
+	if format != ThumbJPEG && (format != ThumbWebP || !util.HasFFmpeg) {
+		return "", ErrNotSupported
+	}
+	size = ThumbSize(size)
+	tp := ThumbPath(p, size, format)
+	if util.FileExists(tp) {
+		return tp, nil
+	}
+	l, _ := thumbLocks.LoadOrStore(tp, &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	defer func() {
+		mu.Unlock()
+		thumbLocks.Delete(tp)
+	}()
+	if util.FileExists(tp) {
+		return tp, nil
+	}
+	src, width, err := thumbSource(p)
+	if err != nil {
+		return "", err
+	}
+	// sizes wider than the original would only be copies of the smallest size that fits it
+	if fit := ThumbSize(width); fit < size {
+		return Thumbnail(p, fit, format)
+	}
+	if err := os.MkdirAll(filepath.Dir(tp), 0755); err != nil {
+		return "", err
+	}
+	// write then rename so a partial thumbnail is never served
+	tmp := tp + "." + util.NewID() + "." + format
+	if format == ThumbWebP {
+		var jp string
+		if jp, err = Thumbnail(p, size, ThumbJPEG); err == nil {
+			err = util.ConvertImage(jp, tmp)
+		}
+	} else {
+		err = resizeImage(tmp, src, uint(size))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, tp); err != nil {
+		return "", err
+	}
+	return tp, nil
+}
+
+// thumbSource returns a decodable image of the media at p with its width,
+// anything else gets a JPEG frame extracted next to it
+func thumbSource(p string) (string, int, error) {
+	isImage := strings.Index(util.TypeByExt(filepath.Ext(p)), "image/") == 0
+	if isImage {
+		if width, _, err := imageSize(p); err == nil {
+			return p, width, nil
+		}
+	}
+	src := p + ".jpg"
+	if !util.FileExists(src) {
+		var err error
+		if isImage {
+			err = util.ConvertImage(p, src)
+		} else {
+			err = util.Thumbnail(p)
+		}
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	width, _, err := imageSize(src)
+	if err != nil {
+		return "", 0, err
+	}
+	return src, width, nil
+}
+
+// resizeImage writes a JPEG of the upright image at fPath scaled to width, the source
+// is scaled along the axis that ends up horizontal and rotated after since it's smaller then
+func resizeImage(out string, fPath string, width uint) error {
+	file, err := os.Open(fPath)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	orientation := imageOrientation(fPath)
+	transposed := orientation >= 5
+	w := uint(img.Bounds().Dx())
+	if transposed {
+		w = uint(img.Bounds().Dy())
+	}
+	// never upscale
+	if w < width {
+		width = w
+	}
+	var m image.Image
+	if transposed {
+		m = resizer.Resize(0, width, img, resizer.Lanczos3)
+	} else {
+		m = resizer.Resize(width, 0, img, resizer.Lanczos3)
+	}
+	m = util.Orient(m, orientation)
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, m, nil); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,239 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/altlimit/dmedia/util"
+)
+
+const (
+	TranscodePending = "pending"
+	TranscodeDone    = "done"
+	TranscodeFailed  = "failed"
+
+	VariantMP4    = "mp4"
+	VariantHLS    = "hls"
+	VariantSprite = "sprite"
+)
+
+type (
+	// TranscodeStatus is kept in the media meta, variants lists what can be requested with ?variant=.
+	// The sprite variant is a strip of util.SpriteFrames tiles util.SpriteWidth wide for hover scrubbing.
+	TranscodeStatus struct {
+		Status   string   `json:"status"`
+		Variants []string `json:"variants,omitempty"`
+		Error    string   `json:"error,omitempty"`
+	}
+)
+
+func variantsDir(p string) string {
+	return filepath.Join(filepath.Dir(p), "variants")
+}
+
+// VariantPath returns the file to serve for a variant of the media at p,
+// hls files are requested as hls/{file} from the urls in its playlists
+func VariantPath(p string, m *Media, variant string) (string, error) {
+	if m.Meta == nil || m.Meta.Transcode == nil {
+		return "", ErrNotFound
+	}
+	hasVariant := func(v string) bool {
+		for _, tv := range m.Meta.Transcode.Variants {
+			if tv == v {
+				return true
+			}
+		}
+		return false
+	}
+	if variant == VariantMP4 && hasVariant(VariantMP4) {
+		proxy := filepath.Join(variantsDir(p), "proxy.mp4")
+		if util.FileExists(proxy) {
+			return proxy, nil
+		}
+		// the original already plays everywhere
+		return p, nil
+	}
+	if variant == VariantSprite && hasVariant(VariantSprite) {
+		return filepath.Join(variantsDir(p), "sprite.jpg"), nil
+	}
+	if strings.Index(variant, VariantHLS) == 0 && hasVariant(VariantHLS) {
+		name := strings.TrimPrefix(strings.TrimPrefix(variant, VariantHLS), "/")
+		if name == "" {
+			name = "master.m3u8"
+		}
+		if name != filepath.Base(name) || strings.Index(name, ".") == 0 {
+			return "", ErrNotFound
+		}
+		hp := filepath.Join(variantsDir(p), "hls", name)
+		if !util.FileExists(hp) {
+			return "", ErrNotFound
+		}
+		return hp, nil
+	}
+	return "", ErrNotFound
+}
+
+// webPlayable checks if a video is already an H.264/AAC MP4 from its ffprobe info
+func webPlayable(cType string, info interface{}) bool {
+	if cType != "video/mp4" {
+		return false
+	}
+	m, _ := info.(map[string]interface{})
+	streams, _ := m["streams"].([]interface{})
+	hasVideo := false
+	for _, st := range streams {
+		s, ok := st.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch s["codec_type"] {
+		case "video":
+			if s["codec_name"] != "h264" || s["pix_fmt"] != "yuv420p" {
+				return false
+			}
+			hasVideo = true
+		case "audio":
+			if s["codec_name"] != "aac" && s["codec_name"] != "mp3" {
+				return false
+			}
+		}
+	}
+	return hasVideo
+}
+
+func (u *User) transcode(mediaID int64) error {
+	m, err := u.GetMediaByID(mediaID)
+	if err != nil {
+		return err
+	}
+	p := m.Path(u.ID)
+	var info interface{}
+	if m.Meta != nil {
+		info = m.Meta.Info
+	}
+	dir := variantsDir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	status := &TranscodeStatus{Status: TranscodeDone}
+	// ffmpeg exiting with an error would fail the same way again
+	var permanent bool
+	if !webPlayable(m.ContentType, info) {
+		proxy := filepath.Join(dir, "proxy.mp4")
+		tmp := proxy + "." + util.NewID()
+		if err := util.TranscodeMP4(p, tmp); err != nil {
+			os.Remove(tmp)
+			status.Status = TranscodeFailed
+			status.Error = err.Error()
+			permanent = ffmpegFailed(err)
+		} else if err := os.Rename(tmp, proxy); err != nil {
+			return err
+		}
+	}
+	if status.Status == TranscodeDone {
+		status.Variants = append(status.Variants, VariantMP4)
+	}
+	if util.HLSEnabled && status.Status == TranscodeDone {
+		hls := filepath.Join(dir, "hls")
+		tmp := hls + "." + util.NewID()
+		if err := os.MkdirAll(tmp, 0755); err != nil {
+			return err
+		}
+		w, h := videoSize(info)
+		if err := util.TranscodeHLS(p, tmp, w, h, url.PathEscape(m.Name)+"?variant=hls/"); err != nil {
+			os.RemoveAll(tmp)
+			status.Status = TranscodeFailed
+			status.Error = err.Error()
+			permanent = ffmpegFailed(err)
+		} else {
+			os.RemoveAll(hls)
+			if err := os.Rename(tmp, hls); err != nil {
+				return err
+			}
+			status.Variants = append(status.Variants, VariantHLS)
+		}
+	}
+	// the sprite doesn't depend on the transcode so a failed one still gets it
+	sprite := filepath.Join(dir, "sprite.jpg")
+	tmp := sprite + "." + util.NewID() + ".jpg"
+	infoMap, _ := info.(map[string]interface{})
+	if err := util.SpriteSheet(p, util.VideoDuration(infoMap), tmp); err != nil {
+		os.Remove(tmp)
+		log.Printf("transcode sprite %d/%d error: %v", u.ID, mediaID, err)
+	} else if err := os.Rename(tmp, sprite); err != nil {
+		return err
+	} else {
+		status.Variants = append(status.Variants, VariantSprite)
+	}
+	if err := u.setTranscodeStatus(mediaID, status); err != nil {
+		return err
+	}
+	// failures are kept in the status and retried by the job unless ffmpeg rejected the video
+	if status.Status == TranscodeFailed {
+		err := fmt.Errorf("transcode error: %s", status.Error)
+		if permanent {
+			return &permanentError{err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// ffmpegFailed is true when ffmpeg ran and exited with an error, not when it's missing or was killed
+func ffmpegFailed(err error) bool {
+	e, ok := err.(*exec.ExitError)
+	return ok && e.ExitCode() > 0
+}
+
+func (u *User) setTranscodeStatus(mediaID int64, status *TranscodeStatus) error {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("setTranscodeStatus getDB error: %v", err)
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(`
+		UPDATE media
+		SET
+			meta = json_set(CASE WHEN json_valid(meta) THEN meta ELSE '{}' END, '$.transcode', json(?)),
+			modified = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, string(b), mediaID); err != nil {
+		return fmt.Errorf("setTranscodeStatus update error: %v", err)
+	}
+	return nil
+}
+
+// QueueTranscodes queues videos added before transcoding existed
+func (u *User) QueueTranscodes() error {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return fmt.Errorf("QueueTranscodes getDB error: %v", err)
+	}
+	var ids []int64
+	if err := db.Select(&ids, `
+		SELECT id
+		FROM media
+		WHERE ctype LIKE 'video/%' AND deleted IS NULL
+		AND json_extract(CASE WHEN json_valid(meta) THEN meta ELSE '{}' END, '$.transcode') IS NULL
+	`); err != nil {
+		return fmt.Errorf("QueueTranscodes select error: %v", err)
+	}
+	for _, id := range ids {
+		if err := QueueJob(u.ID, JobTranscode, id, ""); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("QueueTranscodes user %d queued %d videos", u.ID, len(ids))
+	}
+	return nil
+}
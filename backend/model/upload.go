@@ -0,0 +1,214 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/altlimit/dmedia/util"
+)
+
+var (
+	ErrOffset = fmt.Errorf("offset mismatch")
+
+	uploadLocks sync.Map
+)
+
+type (
+	// UploadSession is a resumable upload staged under the user tmp dir,
+	// the received offset is the size of its data file so it survives restarts
+	UploadSession struct {
+		ID           string `json:"id"`
+		Name         string `json:"name" validate:"required"`
+		ContentType  string `json:"ctype" validate:"required"`
+		Size         int64  `json:"size" validate:"required,min=1"`
+		FallbackDate string `json:"fallbackDate"`
+		Offset       int64  `json:"offset"`
+
+		dir string
+	}
+)
+
+func uploadSessionsDir(userID int64) string {
+	return filepath.Join(dataPath(userID), "tmp", "uploads")
+}
+
+func (us *UploadSession) dataPath() string {
+	return filepath.Join(us.dir, "data")
+}
+
+func (us *UploadSession) lock() func() {
+	l, _ := uploadLocks.LoadOrStore(us.dir, &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// NewUploadSession stages a new resumable upload
+func (u *User) NewUploadSession(us *UploadSession) error {
+	if util.MaxUploadSize > 0 && us.Size > util.MaxUploadSize {
+		return ErrTooLarge
+	}
+	us.ID = util.NewID()
+	us.Offset = 0
+	us.dir = filepath.Join(uploadSessionsDir(u.ID), us.ID)
+	if err := os.MkdirAll(us.dir, 0755); err != nil {
+		return fmt.Errorf("NewUploadSession mkdir error: %v", err)
+	}
+	b, err := json.Marshal(us)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(us.dir, "session.json"), b, 0644); err != nil {
+		return fmt.Errorf("NewUploadSession write session error: %v", err)
+	}
+	if err := ioutil.WriteFile(us.dataPath(), nil, 0644); err != nil {
+		return fmt.Errorf("NewUploadSession write data error: %v", err)
+	}
+	return nil
+}
+
+// GetUploadSession loads a session with its current offset
+func (u *User) GetUploadSession(id string) (*UploadSession, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, ErrNotFound
+	}
+	dir := filepath.Join(uploadSessionsDir(u.ID), id)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "session.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("GetUploadSession read error: %v", err)
+	}
+	us := &UploadSession{dir: dir}
+	if err := json.Unmarshal(b, us); err != nil {
+		return nil, fmt.Errorf("GetUploadSession unmarshal error: %v", err)
+	}
+	fi, err := os.Stat(us.dataPath())
+	if err != nil {
+		return nil, fmt.Errorf("GetUploadSession stat error: %v", err)
+	}
+	us.Offset = fi.Size()
+	return us, nil
+}
+
+// Write appends a chunk at offset which must be the current offset, length is the chunk size or -1 when unknown.
+// A chunk past the declared size is rejected before it's written, one of unknown length is cut back to offset.
+// Whatever was received before any other error is kept so the client can resume from it
+func (us *UploadSession) Write(offset int64, length int64, r io.Reader) error {
+	unlock := us.lock()
+	defer unlock()
+	fi, err := os.Stat(us.dataPath())
+	if err != nil {
+		return fmt.Errorf("UploadSession.Write stat error: %v", err)
+	}
+	us.Offset = fi.Size()
+	if offset != us.Offset {
+		return ErrOffset
+	}
+	if length > us.Size-us.Offset {
+		return ErrTooLarge
+	}
+	file, err := os.OpenFile(us.dataPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("UploadSession.Write open error: %v", err)
+	}
+	defer file.Close()
+	n, err := io.Copy(file, io.LimitReader(r, us.Size-us.Offset))
+	if err != nil {
+		us.Offset += n
+		return fmt.Errorf("UploadSession.Write copy error: %v", err)
+	}
+	// anything past the declared size is an error
+	if extra, _ := r.Read(make([]byte, 1)); extra > 0 {
+		if err := file.Truncate(offset); err != nil {
+			return fmt.Errorf("UploadSession.Write truncate error: %v", err)
+		}
+		return ErrTooLarge
+	}
+	us.Offset += n
+	return file.Close()
+}
+
+// FinishUploadSession adds a complete upload as media and removes the session
+func (u *User) FinishUploadSession(id string) (int64, error) {
+	us, err := u.GetUploadSession(id)
+	if err != nil {
+		return 0, err
+	}
+	unlock := us.lock()
+	defer unlock()
+	if us.Offset != us.Size {
+		return 0, ErrOffset
+	}
+	// the staged file is hashed then moved as is instead of copied through AddMedia
+	size, chk, err := hashFile(us.dataPath())
+	if err != nil {
+		return 0, fmt.Errorf("FinishUploadSession hash error: %v", err)
+	}
+	mediaID, err := u.addMediaFile(us.dataPath(), us.Name, us.ContentType, size, chk, us.FallbackDate)
+	if err != nil {
+		return 0, err
+	}
+	if err := us.remove(); err != nil {
+		log.Printf("FinishUploadSession remove %s error: %v", us.dir, err)
+	}
+	return mediaID, nil
+}
+
+// DeleteUploadSession cancels an upload
+func (u *User) DeleteUploadSession(id string) error {
+	us, err := u.GetUploadSession(id)
+	if err != nil {
+		return err
+	}
+	unlock := us.lock()
+	defer unlock()
+	return us.remove()
+}
+
+func (us *UploadSession) remove() error {
+	uploadLocks.Delete(us.dir)
+	return os.RemoveAll(us.dir)
+}
+
+// CleanUploadSessions removes sessions of every user that did not receive data within ttl
+func CleanUploadSessions(ttl time.Duration) {
+	users, err := GetUsers()
+	if err != nil {
+		log.Printf("CleanUploadSessions get users error: %v", err)
+		return
+	}
+	for _, u := range users {
+		dir := uploadSessionsDir(u.ID)
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("CleanUploadSessions read dir %s error: %v", dir, err)
+			}
+			continue
+		}
+		for _, info := range infos {
+			us := &UploadSession{dir: filepath.Join(dir, info.Name())}
+			fi, err := os.Stat(us.dataPath())
+			if err == nil && time.Since(fi.ModTime()) < ttl {
+				continue
+			}
+			unlock := us.lock()
+			if err := us.remove(); err != nil {
+				log.Printf("CleanUploadSessions remove %s error: %v", us.dir, err)
+			} else {
+				log.Printf("CleanUploadSessions removed %s", us.dir)
+			}
+			unlock()
+		}
+	}
+}
@@ -1,13 +1,12 @@
 package model
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -17,6 +16,7 @@ import (
 	"time"
 
 	"github.com/altlimit/dmedia/util"
+	"github.com/jmoiron/sqlx"
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/rwcarlsen/goexif/tiff"
 	"golang.org/x/crypto/bcrypt"
@@ -48,11 +48,20 @@ type (
 		Deleted     *DateTime `json:"deleted" db:"deleted"`
 		Size        int       `json:"size" db:"size"`
 		Meta        *Meta     `json:"meta" db:"meta"`
+		PHash       *int64    `json:"-" db:"phash"`
+		Country     *string   `json:"country" db:"country"`
+		City        *string   `json:"city" db:"city"`
+		Geohash     *string   `json:"-" db:"geohash"`
+		PhotoInfo
 	}
 
 	Meta struct {
-		Exif interface{} `json:"exif,omitempty"`
-		Info interface{} `json:"info,omitempty"`
+		// Exif is the raw tag dump, the api only returns it when asked for
+		Exif      interface{}      `json:"exif,omitempty"`
+		Info      interface{}      `json:"info,omitempty"`
+		Transcode *TranscodeStatus `json:"transcode,omitempty"`
+		// DateSource is where created came from, one of the Date constants
+		DateSource string `json:"dateSource,omitempty"`
 	}
 	ExifData struct {
 		Data map[string]*tiff.Tag
@@ -153,113 +162,114 @@ func (u *User) Save() error {
 	return saveUser(u)
 }
 
-// AddMediaFromPath adds new media from local path
+// AddMediaFromPath adds new media from local path, its sidecar files and a date in its
+// directories are read for the date and its modified time is the fallback
 func (u *User) AddMediaFromPath(path string) (int64, error) {
 	name := filepath.Base(path)
 	cType := util.TypeByExt(filepath.Ext(name))
-	content, err := ioutil.ReadFile(path)
+	file, err := os.Open(path)
 	if err != nil {
 		return 0, err
 	}
-	fbDate := util.TimeFromPath(path)
-	return u.AddMedia(name, cType, content, fbDate.Format(util.DateTimeFormat))
+	defer file.Close()
+	var fallbackDT string
+	if fi, err := file.Stat(); err == nil {
+		fallbackDT = fi.ModTime().Format(util.DateTimeFormat)
+	}
+	var fromPath *captureDate
+	if t, ok := util.TimeFromString(path); ok {
+		fromPath = &captureDate{time: t, source: DateFilename}
+	}
+	return u.addMedia(name, cType, file, fallbackDT, sidecarDate(path), fromPath)
+}
+
+// AddMedia adds new media to table, content is streamed to the user tmp dir
+// while hashing so it's never held in memory.
+// created is the first found of the EXIF date, the video creation time, a sidecar date,
+// a date in the name then fallbackDT or now, meta.dateSource records which one
+func (u *User) AddMedia(name string, cType string, content io.Reader, fallbackDT string) (int64, error) {
+	return u.addMedia(name, cType, content, fallbackDT)
+}
+
+// addMedia is AddMedia with more date candidates, a date in the name is preferred over others of the same source
+func (u *User) addMedia(name string, cType string, content io.Reader, fallbackDT string, dates ...*captureDate) (int64, error) {
+	if !supportedType(cType) {
+		log.Printf("Found ContentType: %s", cType)
+		return 0, ErrNotSupported
+	}
+	tmpDir := filepath.Join(dataPath(u.ID), "tmp", util.NewID())
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return 0, err
+	}
+	cleanUp := func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.Printf("Failed to delete tmpDir: %s - %v", tmpDir, err)
+		}
+	}
+	defer cleanUp()
+	pFile := filepath.Join(tmpDir, name)
+	size, chk, err := writeContent(pFile, content)
+	if err != nil {
+		return 0, err
+	}
+	return u.addMediaFile(pFile, name, cType, size, chk, fallbackDT, dates...)
+}
+
+func supportedType(cType string) bool {
+	return strings.Index(cType, "video/") == 0 || strings.Index(cType, "image/") == 0
 }
 
-// AddMedia adds new media to table
-func (u *User) AddMedia(name string, cType string, content []byte, fallbackDT string) (int64, error) {
+// addMediaFile adds a file already in the user data dir, it's moved to the media dir
+// unless the checksum exists which leaves it for the caller to remove
+func (u *User) addMediaFile(pFile string, name string, cType string, size int64, chk string, fallbackDT string, dates ...*captureDate) (int64, error) {
 	var (
-		exd         string
-		isVideo     bool
-		meta        *Meta
-		createdTime time.Time
-		err         error
+		exd     string
+		isVideo bool
+		meta    = &Meta{}
+		err     error
 	)
-	if len(content) == 0 {
-		return 0, fmt.Errorf("AddMedia: error content is empty")
-	}
+	fallback := &captureDate{time: time.Now(), source: DateFallback}
 	if fallbackDT != "" {
-		createdTime, err = time.Parse(util.DateTimeFormat, fallbackDT)
+		fallback.time, err = time.Parse(util.DateTimeFormat, fallbackDT)
 		if err != nil {
 			return 0, fmt.Errorf("AddMedia: error time.Parse %v", err)
 		}
-	} else {
-		createdTime, _ = util.TimeFromString(name)
 	}
-	created := createdTime.Format(util.DateTimeFormat)
-	if strings.Index(cType, "image/") == 0 {
-		// read exif info
-		x, err := exif.Decode(bytes.NewReader(content))
-		ed := &ExifData{}
-		if err == nil {
-			if err := x.Walk(ed); err != nil {
-				return 0, err
-			}
-			if len(ed.Data) > 0 {
-				meta = &Meta{Exif: ed.Data}
-				// find possible date
-				for k, v := range ed.Data {
-					if strings.Contains(k, "DateTime") {
-						dts, err := v.StringVal()
-						if err == nil {
-							t, err := time.Parse("2006:01:02 15:04:05", dts)
-							if err == nil {
-								created = t.Format(util.DateTimeFormat)
-								break
-							}
-						}
-					}
-				}
-			}
-		}
-	} else if strings.Index(cType, "video/") == 0 {
+	var fromName *captureDate
+	if t, ok := util.TimeFromString(name); ok {
+		fromName = &captureDate{time: t, source: DateFilename}
+	}
+	if strings.Index(cType, "video/") == 0 {
 		isVideo = true
-	} else {
+	} else if strings.Index(cType, "image/") != 0 {
 		log.Printf("Found ContentType: %s", cType)
 		return 0, ErrNotSupported
 	}
+	if size == 0 {
+		return 0, fmt.Errorf("AddMedia: error content is empty")
+	}
 	db, err := getDB(u.ID)
 	if err != nil {
 		return 0, err
 	}
-	if err != nil {
-		log.Fatal(err)
-	}
 	dp := dataPath(u.ID)
-	tmpDir := filepath.Join(dp, "tmp", util.NewID())
-	if err := os.MkdirAll(tmpDir, 0755); err != nil {
-		return 0, err
-	}
-	pFile := filepath.Join(tmpDir, name)
-	if err := ioutil.WriteFile(pFile, content, 0644); err != nil {
-		return 0, err
-	}
-	cleanUp := func() {
-		if err := os.RemoveAll(tmpDir); err != nil {
-			log.Printf("Failed to delete tmpDir: %s - %v", tmpDir, err)
-		}
-	}
-	defer cleanUp()
 	if isVideo {
-		if info := util.VideoInfo(pFile); info != nil {
-			meta = &Meta{Info: info}
-		}
+		meta.Transcode = &TranscodeStatus{Status: TranscodePending}
 	}
-	if meta != nil {
-		ex, err := json.Marshal(meta)
-		if err != nil {
-			return 0, err
-		}
-		exd = string(ex)
+	// EXIF, size and details are read by the probe job which moves the media when its date is more trusted
+	date := firstDate(append(append([]*captureDate{fromName}, dates...), fallback)...)
+	created := date.time.Format(util.DateTimeFormat)
+	meta.DateSource = date.source
+	ex, err := json.Marshal(meta)
+	if err != nil {
+		return 0, err
 	}
-	chk := fmt.Sprintf("%x", sha1.Sum(content))
+	exd = string(ex)
 	res, err := db.Exec(`
-		insert into media(name, ctype, checksum, created, size, meta, modified)
-		values(?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`,
-		name, cType, chk, created, len(content), exd)
+		insert into media(name, ctype, checksum, created, size, meta, taken_at, modified)
+		values(?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`,
+		name, cType, chk, created, size, exd, date.takenAt())
 	if err != nil {
-		if err := os.Remove(pFile); err != nil {
-			return 0, err
-		}
 		if err.Error() == "UNIQUE constraint failed: media.checksum" {
 			r := db.QueryRow(`SELECT id FROM media WHERE checksum = ?`, chk)
 			var id int64
@@ -285,42 +295,296 @@ func (u *User) AddMedia(name string, cType string, content []byte, fallbackDT st
 		}
 		return 0, err
 	}
+	if _, err := db.Exec(mediaSearchInsert+` WHERE id = ?`, id); err != nil {
+		log.Printf("AddMedia search index %d error: %v", id, err)
+	}
+	if err := QueueJob(u.ID, JobProbe, id, ""); err != nil {
+		log.Printf("AddMedia queue %s %d error: %v", JobProbe, id, err)
+	}
 	return id, nil
 }
 
-func (u *User) GetAllMedia(deleted bool, page int, limit int) ([]Media, int, error) {
+// probeMedia reads the details and size of a media, moves it to the date found in them
+// when that's more trusted than where its date came from, then queues what needs them
+func (u *User) probeMedia(id int64) error {
+	m, err := u.GetMediaByID(id)
+	if err != nil {
+		return err
+	}
 	db, err := getDB(u.ID)
 	if err != nil {
-		return nil, 0, fmt.Errorf("GetAllMedia getDB error: %v", err)
+		return fmt.Errorf("probeMedia getDB error: %v", err)
 	}
 	var (
-		where string
-		args  []interface{}
+		date *captureDate
+		jobs []string
 	)
-	if deleted {
-		where = "WHERE deleted IS NOT NULL"
+	if strings.Index(m.ContentType, "video/") == 0 {
+		date, err = u.probeVideo(db, m)
+		jobs = []string{JobThumbnail, JobTranscode, JobLocate}
 	} else {
-		where = "WHERE deleted IS NULL"
+		date, err = u.probeImage(db, m)
+		jobs = []string{JobThumbnail, JobPHash, JobLocate}
+	}
+	if err != nil {
+		return err
+	}
+	var source string
+	if m.Meta != nil {
+		source = m.Meta.DateSource
+	}
+	if date != nil && dateRank(date.source) < dateRank(source) {
+		if err := u.setCaptureDate(m, date); err != nil {
+			return err
+		}
+	}
+	// thumbnails are made after the move so they're not left in the old directory
+	for _, jtype := range jobs {
+		if err := QueueJob(u.ID, jtype, id, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// probeVideo stores the ffprobe details and size of a video returning its creation time
+func (u *User) probeVideo(db *sqlx.DB, m *Media) (*captureDate, error) {
+	info := util.VideoInfo(m.Path(u.ID))
+	if info == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	w, h := videoSize(info)
+	if _, err := db.Exec(`
+		UPDATE media
+		SET
+			meta = json_set(CASE WHEN json_valid(meta) THEN meta ELSE '{}' END, '$.info', json(?)),
+			width = ?,
+			height = ?,
+			modified = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, string(b), w, h, m.ID); err != nil {
+		return nil, fmt.Errorf("probeVideo update error: %v", err)
 	}
+	// codecs and format tags are searchable
+	if err := reindexMedia(db, m.ID); err != nil {
+		return nil, fmt.Errorf("probeVideo %v", err)
+	}
+	return videoDate(info), nil
+}
+
+// probeImage stores the EXIF tags, photo info and size of an image returning its EXIF date
+func (u *User) probeImage(db *sqlx.DB, m *Media) (*captureDate, error) {
+	p := m.Path(u.ID)
+	w, h := mediaSize(p, m.ContentType, nil)
+	info, fromExif := imagePhotoInfo(p)
+	var exd *string
+	if ed := readExif(p); ed != nil {
+		b, err := json.Marshal(ed.Data)
+		if err != nil {
+			return nil, err
+		}
+		s := string(b)
+		exd = &s
+	}
+	if _, err := db.Exec(`
+		UPDATE media
+		SET
+			meta = CASE WHEN ? IS NULL THEN meta
+				ELSE json_set(CASE WHEN json_valid(meta) THEN meta ELSE '{}' END, '$.exif', json(?)) END,
+			width = ?,
+			height = ?,
+			make = ?, model = ?, lens = ?, focal_length = ?, aperture = ?, iso = ?, exposure = ?,
+			taken_at = COALESCE(?, taken_at),
+			orientation = ?,
+			modified = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, exd, exd, w, h, info.Make, info.Model, info.Lens, info.FocalLength, info.Aperture, info.ISO, info.Exposure,
+		info.TakenAt, info.Orientation, m.ID); err != nil {
+		return nil, fmt.Errorf("probeImage update error: %v", err)
+	}
+	// camera and lens tags are searchable
+	if err := reindexMedia(db, m.ID); err != nil {
+		return nil, fmt.Errorf("probeImage %v", err)
+	}
+	return fromExif, nil
+}
+
+// reindexMedia updates the search index of a media after its meta changed
+func reindexMedia(db *sqlx.DB, id int64) error {
+	if _, err := db.Exec(`DELETE FROM media_search WHERE rowid = ?`, id); err != nil {
+		return fmt.Errorf("delete search error: %v", err)
+	}
+	if _, err := db.Exec(mediaSearchInsert+` WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("search index error: %v", err)
+	}
+	return nil
+}
+
+// writeContent streams content to path returning its size and sha1 checksum,
+// it stops with ErrTooLarge past util.MaxUploadSize
+func writeContent(path string, content io.Reader) (int64, string, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	if util.MaxUploadSize > 0 {
+		content = io.LimitReader(content, util.MaxUploadSize+1)
+	}
+	h := sha1.New()
+	size, err := io.Copy(io.MultiWriter(file, h), content)
+	if err != nil {
+		return 0, "", err
+	}
+	if util.MaxUploadSize > 0 && size > util.MaxUploadSize {
+		return 0, "", ErrTooLarge
+	}
+	if err := file.Close(); err != nil {
+		return 0, "", err
+	}
+	return size, fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashFile returns the size and sha1 checksum of a file
+func hashFile(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	h := sha1.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// readExif returns the exif tags of an image file or nil if it has none
+func readExif(path string) *ExifData {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	x, err := exif.Decode(file)
+	if err != nil {
+		return nil
+	}
+	ed := &ExifData{}
+	if err := x.Walk(ed); err != nil || len(ed.Data) == 0 {
+		return nil
+	}
+	return ed
+}
+
+func (u *User) GetAllMedia(filter *MediaFilter, page int, limit int) ([]Media, int, error) {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("GetAllMedia getDB error: %v", err)
+	}
+	where, args := filter.where()
 	allMedia := []Media{}
 	err = db.Select(&allMedia, fmt.Sprintf(`
 		SELECT *
 		FROM media
 		%s
-		ORDER BY created DESC
+		ORDER BY created DESC, id DESC
 		LIMIT %d
 		OFFSET %d
 	`, where, limit, (limit*page)-limit), args...)
 	if err != nil {
 		return nil, 0, fmt.Errorf("GetAllMedia db select error: %v", err)
 	}
-	var total int
-	if err := db.Get(&total, `SELECT COUNT(1) FROM media`); err != nil {
-		return nil, 0, fmt.Errorf("GetAllMedia select count error %v", err)
+	total, err := u.CountMedia(filter)
+	if err != nil {
+		return nil, 0, err
 	}
 	return allMedia, total, nil
 }
 
+// GetMediaAfter pages media by keyset on (created, id), a nil cursor starts from the newest.
+// The returned cursor is nil when there are no more media.
+func (u *User) GetMediaAfter(filter *MediaFilter, cursor *MediaCursor, limit int) ([]Media, *MediaCursor, error) {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("GetMediaAfter getDB error: %v", err)
+	}
+	where, args := filter.where()
+	if cursor != nil {
+		where += " AND (created < ? OR (created = ? AND id < ?))"
+		args = append(args, cursor.Created, cursor.Created, cursor.ID)
+	}
+	allMedia := []Media{}
+	err = db.Select(&allMedia, fmt.Sprintf(`
+		SELECT *
+		FROM media
+		%s
+		ORDER BY created DESC, id DESC
+		LIMIT %d
+	`, where, limit+1), args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("GetMediaAfter db select error: %v", err)
+	}
+	var next *MediaCursor
+	if len(allMedia) > limit {
+		allMedia = allMedia[:limit]
+		last := allMedia[limit-1]
+		next = &MediaCursor{
+			Created: time.Time(last.Created).Format(util.DateTimeFormat),
+			ID:      last.ID,
+		}
+	}
+	return allMedia, next, nil
+}
+
+// CountMedia returns the number of media matching the filter
+func (u *User) CountMedia(filter *MediaFilter) (int, error) {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return 0, fmt.Errorf("CountMedia getDB error: %v", err)
+	}
+	where, args := filter.where()
+	var total int
+	if err := db.Get(&total, fmt.Sprintf(`SELECT COUNT(1) FROM media %s`, where), args...); err != nil {
+		return 0, fmt.Errorf("CountMedia select count error %v", err)
+	}
+	return total, nil
+}
+
+// GetMediaByChecksums returns media with their id, checksum and size keyed by checksum,
+// media in trash are included the same way AddMedia treats them as existing
+func (u *User) GetMediaByChecksums(checksums []string) (map[string]Media, error) {
+	db, err := getDB(u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("GetMediaByChecksums getDB error: %v", err)
+	}
+	found := make(map[string]Media)
+	// stay under sqlite max variables
+	for i := 0; i < len(checksums); i += 500 {
+		end := i + 500
+		if end > len(checksums) {
+			end = len(checksums)
+		}
+		query, args, err := sqlx.In(`SELECT id, checksum, size FROM media WHERE checksum IN (?)`, checksums[i:end])
+		if err != nil {
+			return nil, fmt.Errorf("GetMediaByChecksums sqlx.In error: %v", err)
+		}
+		medias := []Media{}
+		if err := db.Select(&medias, db.Rebind(query), args...); err != nil {
+			return nil, fmt.Errorf("GetMediaByChecksums select error: %v", err)
+		}
+		for _, m := range medias {
+			found[m.Checksum] = m
+		}
+	}
+	return found, nil
+}
+
 func (u *User) GetMediaByID(id int64) (*Media, error) {
 	db, err := getDB(u.ID)
 	if err != nil {
@@ -394,6 +658,11 @@ func (u *User) DeleteMediaById(ids []int64) error {
 	}
 
 	if len(delIDs) > 0 {
+		// tombstones let other devices drop their cached copy through GetMediaChanges
+		if _, err := db.Exec(fmt.Sprintf(`INSERT OR REPLACE INTO media_tombstone(media_id, deleted)
+		SELECT id, CURRENT_TIMESTAMP FROM media WHERE id IN (%s)`, strings.Join(util.Int64ToStrings(delIDs), ","))); err != nil {
+			return fmt.Errorf("DeleteMediaById tombstone error %v", err)
+		}
 		res, err := db.Exec(fmt.Sprintf(`DELETE FROM media
 		WHERE id IN (%s)`, strings.Join(util.Int64ToStrings(delIDs), ",")))
 		if err != nil {
@@ -403,6 +672,14 @@ func (u *User) DeleteMediaById(ids []int64) error {
 		if err != nil {
 			return fmt.Errorf("DeleteMediaById RowsAffected error %v", err)
 		}
+		if _, err := db.Exec(fmt.Sprintf(`DELETE FROM album_media
+		WHERE media_id IN (%s)`, strings.Join(util.Int64ToStrings(delIDs), ","))); err != nil {
+			return fmt.Errorf("DeleteMediaById delete album_media error %v", err)
+		}
+		if _, err := db.Exec(fmt.Sprintf(`DELETE FROM media_search
+		WHERE rowid IN (%s)`, strings.Join(util.Int64ToStrings(delIDs), ","))); err != nil {
+			return fmt.Errorf("DeleteMediaById delete media_search error %v", err)
+		}
 		delFiles := len(pathsToDelete)
 		if int(affected) != delFiles {
 			log.Printf("[WARNING] DeleteMediaById permanent deletion ids didn't match paths: %v -> %v", affected, pathsToDelete)
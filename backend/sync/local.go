@@ -0,0 +1,245 @@
+package sync
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+)
+
+// Local mirrors originals into a directory like another disk or an NFS mount, Template is
+// the path under Root/{user} with {yyyy}, {mm}, {dd}, {date}, {id} and {name}
+type Local struct {
+	Root     string `json:"root"`
+	Template string `json:"template"`
+}
+
+const defaultLocalTemplate = "{yyyy}/{mm}/{name}"
+
+var (
+	ErrChecksum = errors.New("checksum mismatch")
+
+	errNoOriginal  = errors.New("original not found")
+	errInvalidMeta = errors.New("invalid meta")
+)
+
+func init() {
+	Register(&Target{
+		Type: "local",
+		Name: "Local Directory",
+		Fields: []Field{
+			{Name: "root", Label: "Root", Type: FieldString, Required: true, Check: checkLocalRoot, Description: "Existing directory like another disk or a mount"},
+			{Name: "template", Label: "Template", Type: FieldString, Default: defaultLocalTemplate,
+				Description: "Path under root with {yyyy}, {mm}, {dd}, {date}, {id} and {name}",
+				Check: func(v interface{}) string {
+					return checkLocalTemplate(v.(string))
+				}},
+		},
+		New: func() Sync { return &Local{} },
+		Validate: func(c model.SyncConfig) ConfigError {
+			if !writable(c["root"].(string)) {
+				return ConfigError{"root": "not writable"}
+			}
+			return nil
+		},
+		// the server's disk is only open to everyone when SYNC_LOCAL_ROOTS confines it
+		Allowed: func(u *model.User) bool {
+			return len(util.SyncLocalRoots) > 0 || (u != nil && u.IsAdmin)
+		},
+	})
+}
+
+func (l *Local) Valid() bool {
+	if l.Root == "" || checkLocalRoot(l.Root) != "" || checkLocalTemplate(l.template()) != "" {
+		return false
+	}
+	return writable(l.Root)
+}
+
+// checkLocalRoot is a Field.Check for an absolute root outside of DATA_PATH and in SYNC_LOCAL_ROOTS when set,
+// symlinks are followed so they can't point elsewhere
+func checkLocalRoot(v interface{}) string {
+	if msg := checkAbsPath(v); msg != "" {
+		return msg
+	}
+	root := realPath(v.(string))
+	if inDir(realPath(util.DataPath), root) {
+		return "not allowed"
+	}
+	if len(util.SyncLocalRoots) == 0 {
+		return ""
+	}
+	for _, dir := range util.SyncLocalRoots {
+		if inDir(realPath(dir), root) {
+			return ""
+		}
+	}
+	return "not allowed"
+}
+
+// realPath is the absolute path with symlinks resolved or just cleaned when it doesn't exist
+func realPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	if real, err := filepath.EvalSymlinks(p); err == nil {
+		return real
+	}
+	return filepath.Clean(p)
+}
+
+func checkLocalTemplate(tpl string) string {
+	if !strings.Contains(tpl, "{name}") {
+		return "must have {name}"
+	}
+	if filepath.IsAbs(tpl) {
+		return "must be relative"
+	}
+	for _, part := range strings.Split(filepath.ToSlash(tpl), "/") {
+		if part == ".." {
+			return "invalid"
+		}
+	}
+	return ""
+}
+
+// writable is true when dir exists and a file can be made in it,
+// a missing mount shouldn't create it on the local disk
+func writable(dir string) bool {
+	tmp, err := ioutil.TempFile(dir, ".dmedia-*.tmp")
+	if err != nil {
+		return false
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	return true
+}
+
+// CanRetry is true for io errors since the disk or mount may be back later,
+// a bad copy or a missing original won't fix itself
+func (l *Local) CanRetry(err error) bool {
+	return err != ErrChecksum && err != errNoOriginal && err != errInvalidMeta
+}
+
+func (l *Local) template() string {
+	if l.Template == "" {
+		return defaultLocalTemplate
+	}
+	return l.Template
+}
+
+// relPath is the mirror path of m relative to Root, it starts with the user
+// so users sharing a root never share or delete each other's files
+func (l *Local) relPath(user string, m *model.Media, name string) string {
+	created := time.Time(m.Created)
+	p := strings.NewReplacer(
+		"{yyyy}", created.Format("2006"),
+		"{mm}", created.Format("01"),
+		"{dd}", created.Format("02"),
+		"{date}", created.Format(util.DateFormat),
+		"{id}", util.I64toa(m.ID),
+		"{name}", name,
+	).Replace(l.template())
+	return filepath.Join(user, filepath.FromSlash(p))
+}
+
+// Upload copies to a temp file in the destination directory, verifies it then renames it,
+// a different file already at the path gets the media id added to the name
+func (l *Local) Upload(m *model.Media, path string) (string, error) {
+	// originals are in DATA_PATH/{user}/
+	rel, err := filepath.Rel(util.DataPath, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("Local Upload rel error %v", err)
+	}
+	user := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+	src, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errNoOriginal
+		}
+		return "", fmt.Errorf("Local Upload open error %v", err)
+	}
+	defer src.Close()
+	rel = l.relPath(user, m, m.Name)
+	dst := filepath.Join(l.Root, rel)
+	if chk, err := fileSHA1(dst); err == nil {
+		if chk == m.Checksum {
+			return rel, nil
+		}
+		ext := filepath.Ext(m.Name)
+		rel = l.relPath(user, m, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(m.Name, ext), m.ID, ext))
+		dst = filepath.Join(l.Root, rel)
+		if chk, err := fileSHA1(dst); err == nil && chk == m.Checksum {
+			return rel, nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", fmt.Errorf("Local Upload mkdir error %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".dmedia-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("Local Upload temp error %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("Local Upload copy error %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("Local Upload sync error %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("Local Upload close error %v", err)
+	}
+	// read back what was written rather than trusting the copy
+	chk, err := fileSHA1(tmp.Name())
+	if err != nil {
+		return "", fmt.Errorf("Local Upload verify error %v", err)
+	}
+	if chk != m.Checksum {
+		return "", ErrChecksum
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", fmt.Errorf("Local Upload rename error %v", err)
+	}
+	return rel, nil
+}
+
+// Delete removes the mirrored file and the directories it leaves empty
+func (l *Local) Delete(meta string) error {
+	p := filepath.Join(l.Root, filepath.Clean(meta))
+	if !strings.HasPrefix(p, filepath.Clean(l.Root)+string(filepath.Separator)) {
+		return errInvalidMeta
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Local Delete error %v", err)
+	}
+	for dir := filepath.Dir(p); dir != filepath.Clean(l.Root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func fileSHA1(p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
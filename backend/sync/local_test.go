@@ -0,0 +1,145 @@
+package sync
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+)
+
+func sha1Hex(s string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(s)))
+}
+
+// localFiles lists the files under root relative to it
+func localFiles(t *testing.T, root string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestLocalUpload(t *testing.T) {
+	created, _ := time.Parse(util.DateTimeFormat, "2021-05-06 07:08:09")
+	m := &model.Media{ID: 42, Name: "a.jpg", ContentType: "image/jpeg", Created: model.DateTime(created), Checksum: sha1Hex("jpeg data")}
+	tests := []struct {
+		name     string
+		existing map[string]string
+		checksum string
+		err      error
+		want     string
+		files    map[string]string
+	}{
+		{"new", nil, "", nil, "7/2021/05/a.jpg",
+			map[string]string{"7/2021/05/a.jpg": "jpeg data"}},
+		{"already copied", map[string]string{"7/2021/05/a.jpg": "jpeg data"}, "", nil, "7/2021/05/a.jpg",
+			map[string]string{"7/2021/05/a.jpg": "jpeg data"}},
+		{"name taken", map[string]string{"7/2021/05/a.jpg": "other"}, "", nil, "7/2021/05/a_42.jpg",
+			map[string]string{"7/2021/05/a.jpg": "other", "7/2021/05/a_42.jpg": "jpeg data"}},
+		{"other user", map[string]string{"8/2021/05/a.jpg": "jpeg data"}, "", nil, "7/2021/05/a.jpg",
+			map[string]string{"8/2021/05/a.jpg": "jpeg data", "7/2021/05/a.jpg": "jpeg data"}},
+		{"checksum mismatch", nil, sha1Hex("other"), ErrChecksum, "", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for rel, content := range tt.existing {
+				p := filepath.Join(root, filepath.FromSlash(rel))
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tm := *m
+			if tt.checksum != "" {
+				tm.Checksum = tt.checksum
+			}
+			p := testMedia(t, 7, &tm, "jpeg data")
+			l := &Local{Root: root}
+			got, err := l.Upload(&tm, p)
+			if err != tt.err {
+				t.Fatalf("Upload() error %v, want %v", err, tt.err)
+			}
+			if filepath.ToSlash(got) != tt.want {
+				t.Errorf("Upload() = %s, want %s", got, tt.want)
+			}
+			// temp files are renamed or removed
+			if files := localFiles(t, root); fmt.Sprint(files) != fmt.Sprint(tt.files) {
+				t.Errorf("files = %v, want %v", files, tt.files)
+			}
+			if err != nil && l.CanRetry(err) {
+				t.Errorf("CanRetry(%v) = true", err)
+			}
+		})
+	}
+}
+
+func TestLocalDelete(t *testing.T) {
+	created, _ := time.Parse(util.DateTimeFormat, "2021-05-06 07:08:09")
+	root := t.TempDir()
+	l := &Local{Root: root}
+	var metas []string
+	// the same photo of two users
+	for _, userID := range []int64{7, 8} {
+		m := &model.Media{ID: 1, Name: "a.jpg", ContentType: "image/jpeg", Created: model.DateTime(created), Checksum: sha1Hex("jpeg data")}
+		meta, err := l.Upload(m, testMedia(t, userID, m, "jpeg data"))
+		if err != nil {
+			t.Fatalf("Upload() user %d error %v", userID, err)
+		}
+		metas = append(metas, meta)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "8", "2021", "06"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Delete(metas[0]); err != nil {
+		t.Fatalf("Delete() error %v", err)
+	}
+	if files := localFiles(t, root); len(files) != 1 || files["8/2021/05/a.jpg"] != "jpeg data" {
+		t.Errorf("Delete() left %v, want the other user's copy", files)
+	}
+	// empty directories are pruned up to the root
+	if _, err := os.Stat(filepath.Join(root, "7")); !os.IsNotExist(err) {
+		t.Errorf("Delete() left the empty user directory, stat error %v", err)
+	}
+	if err := l.Delete(metas[1]); err != nil {
+		t.Fatalf("Delete() error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "8", "2021", "06")); err != nil {
+		t.Errorf("Delete() removed an unrelated directory, stat error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "8", "2021", "05")); !os.IsNotExist(err) {
+		t.Errorf("Delete() left an empty directory, stat error %v", err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("Delete() removed the root, stat error %v", err)
+	}
+	// already deleted files are fine
+	if err := l.Delete(metas[1]); err != nil {
+		t.Errorf("Delete() missing error %v", err)
+	}
+	if err := l.Delete("../outside.jpg"); err != errInvalidMeta {
+		t.Errorf("Delete() outside root error %v, want %v", err, errInvalidMeta)
+	}
+}
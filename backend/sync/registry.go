@@ -0,0 +1,171 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/altlimit/dmedia/model"
+)
+
+// config field types
+const (
+	FieldString   = "string"
+	FieldPassword = "password"
+	FieldText     = "text"
+	FieldBool     = "bool"
+)
+
+type (
+	// Field describes a config field so clients can render a form for it
+	Field struct {
+		Name        string      `json:"name"`
+		Label       string      `json:"label"`
+		Type        string      `json:"type"`
+		Required    bool        `json:"required,omitempty"`
+		Default     interface{} `json:"default,omitempty"`
+		Description string      `json:"description,omitempty"`
+		// Check returns why a value that is set is invalid
+		Check func(v interface{}) string `json:"-"`
+	}
+
+	// Target is a sync type, New returns an empty syncer the config is decoded into by json tags
+	Target struct {
+		Type   string  `json:"type"`
+		Name   string  `json:"name"`
+		Fields []Field `json:"fields"`
+
+		New func() Sync `json:"-"`
+		// Validate checks the config across fields after each field is valid
+		Validate func(c model.SyncConfig) ConfigError `json:"-"`
+		// Allowed is whether a user can use the type, nil allows everyone
+		Allowed func(u *model.User) bool `json:"-"`
+	}
+
+	// ConfigError is the reason by config field name
+	ConfigError map[string]string
+)
+
+var (
+	targets = make(map[string]*Target)
+)
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("config error %v", map[string]string(e))
+}
+
+// Register adds a sync type, it's called by each target on init
+func Register(t *Target) {
+	if _, ok := targets[t.Type]; ok {
+		panic("sync type " + t.Type + " already registered")
+	}
+	targets[t.Type] = t
+}
+
+// Targets returns the sync types u can use by type
+func Targets(u *model.User) []*Target {
+	var list []*Target
+	for _, t := range targets {
+		if t.allowed(u) {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Type < list[j].Type
+	})
+	return list
+}
+
+func (t *Target) allowed(u *model.User) bool {
+	return t.Allowed == nil || t.Allowed(u)
+}
+
+// check validates each field then the whole config
+func (t *Target) check(c model.SyncConfig) ConfigError {
+	errs := make(ConfigError)
+	for _, f := range t.Fields {
+		v, ok := c[f.Name]
+		if !ok || v == nil || v == "" {
+			if f.Required {
+				errs[f.Name] = "required"
+			}
+			continue
+		}
+		if f.Type == FieldBool {
+			if _, ok := v.(bool); !ok {
+				errs[f.Name] = "invalid"
+				continue
+			}
+		} else if _, ok := v.(string); !ok {
+			errs[f.Name] = "invalid"
+			continue
+		}
+		if f.Check != nil {
+			if msg := f.Check(v); msg != "" {
+				errs[f.Name] = msg
+			}
+		}
+	}
+	if len(errs) == 0 && t.Validate != nil {
+		errs = t.Validate(c)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// syncer decodes a checked config into the target's syncer
+func (t *Target) syncer(c model.SyncConfig) (Sync, error) {
+	conf := make(map[string]interface{})
+	for _, f := range t.Fields {
+		if v, ok := c[f.Name]; ok && v != nil && v != "" {
+			conf[f.Name] = v
+		} else if f.Default != nil {
+			conf[f.Name] = f.Default
+		}
+	}
+	b, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	s := t.New()
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkURL is a Field.Check for http and https urls
+func checkURL(v interface{}) string {
+	u, err := url.ParseRequestURI(v.(string))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "invalid url"
+	}
+	return ""
+}
+
+// checkAbsPath is a Field.Check for absolute paths
+func checkAbsPath(v interface{}) string {
+	if !filepath.IsAbs(v.(string)) {
+		return "must be absolute"
+	}
+	return ""
+}
+
+// inDir is true when p is dir or under it
+func inDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkNoSpace is a Field.Check for values that can't have white space like hosts and keys
+func checkNoSpace(v interface{}) string {
+	if strings.ContainsAny(v.(string), " \t\r\n") {
+		return "invalid"
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+)
+
+// testSync is a syncer to decode test configs into
+type testSync struct {
+	Name   string `json:"name"`
+	Flag   bool   `json:"flag"`
+	Secret string `json:"secret"`
+}
+
+func (s *testSync) Valid() bool                                     { return true }
+func (s *testSync) CanRetry(error) bool                             { return false }
+func (s *testSync) Upload(m *model.Media, p string) (string, error) { return p, nil }
+func (s *testSync) Delete(meta string) error                        { return nil }
+
+func testTarget() *Target {
+	return &Target{
+		Type: "test",
+		Fields: []Field{
+			{Name: "name", Type: FieldString, Required: true, Check: checkNoSpace},
+			{Name: "flag", Type: FieldBool, Default: true},
+			{Name: "secret", Type: FieldPassword, Default: "default"},
+			{Name: "url", Type: FieldString, Check: checkURL},
+		},
+		New: func() Sync { return &testSync{} },
+		Validate: func(c model.SyncConfig) ConfigError {
+			if c["flag"] == false && c["secret"] == nil {
+				return ConfigError{"secret": "required"}
+			}
+			return nil
+		},
+	}
+}
+
+func TestTargetCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		conf model.SyncConfig
+		want ConfigError
+	}{
+		{"valid", model.SyncConfig{"name": "a", "flag": true}, nil},
+		{"missing", model.SyncConfig{}, ConfigError{"name": "required"}},
+		{"empty", model.SyncConfig{"name": ""}, ConfigError{"name": "required"}},
+		{"null", model.SyncConfig{"name": nil}, ConfigError{"name": "required"}},
+		{"string for bool", model.SyncConfig{"name": "a", "flag": "true"}, ConfigError{"flag": "invalid"}},
+		{"bool for string", model.SyncConfig{"name": true}, ConfigError{"name": "invalid"}},
+		{"number for password", model.SyncConfig{"name": "a", "secret": 1.0}, ConfigError{"secret": "invalid"}},
+		{"check", model.SyncConfig{"name": "a b", "url": "ftp://x"}, ConfigError{"name": "invalid", "url": "invalid url"}},
+		{"every field", model.SyncConfig{"flag": 1.0, "url": "x"}, ConfigError{"name": "required", "flag": "invalid", "url": "invalid url"}},
+		{"cross field", model.SyncConfig{"name": "a", "flag": false}, ConfigError{"secret": "required"}},
+		{"cross field after fields", model.SyncConfig{"name": "a b", "flag": false}, ConfigError{"name": "invalid"}},
+		{"cross field valid", model.SyncConfig{"name": "a", "flag": false, "secret": "s"}, nil},
+	}
+	target := testTarget()
+	for _, tt := range tests {
+		got := target.check(tt.conf)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: check() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTargetSyncer(t *testing.T) {
+	target := testTarget()
+	s, err := target.syncer(model.SyncConfig{"name": "a", "secret": "", "ignored": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &testSync{Name: "a", Flag: true, Secret: "default"}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("syncer() = %+v, want %+v", s, want)
+	}
+	s, err = target.syncer(model.SyncConfig{"name": "a", "flag": false, "secret": "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &testSync{Name: "a", Flag: false, Secret: "s"}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("syncer() = %+v, want %+v", s, want)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	types := func(u *model.User) []string {
+		var list []string
+		for _, t := range Targets(u) {
+			list = append(list, t.Type)
+		}
+		return list
+	}
+	roots := util.SyncLocalRoots
+	defer func() { util.SyncLocalRoots = roots }()
+
+	util.SyncLocalRoots = nil
+	if got, want := types(&model.User{}), []string{"s3", "sftp", "telegram", "webdav"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Targets(user) = %v, want %v", got, want)
+	}
+	if got, want := types(&model.User{IsAdmin: true}), []string{"local", "s3", "sftp", "telegram", "webdav"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Targets(admin) = %v, want %v", got, want)
+	}
+	util.SyncLocalRoots = []string{t.TempDir()}
+	if got, want := types(&model.User{}), []string{"local", "s3", "sftp", "telegram", "webdav"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Targets(user) with roots = %v, want %v", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Register() of a registered type didn't panic")
+		}
+	}()
+	Register(&Target{Type: "s3"})
+}
+
+func TestSyncFromLocation(t *testing.T) {
+	dp, roots := util.DataPath, util.SyncLocalRoots
+	defer func() { util.DataPath, util.SyncLocalRoots = dp, roots }()
+	util.DataPath = t.TempDir()
+	util.SyncLocalRoots = nil
+	admin := &model.User{IsAdmin: true}
+	root := t.TempDir()
+
+	tests := []struct {
+		name string
+		u    *model.User
+		loc  *model.SyncLocation
+		want error
+	}{
+		{"unknown type", admin, &model.SyncLocation{Type: "ftp"}, ErrType},
+		{"not allowed", &model.User{}, &model.SyncLocation{Type: "local", Config: model.SyncConfig{"root": root}}, ErrType},
+		{"config error", admin, &model.SyncLocation{Type: "local", Config: model.SyncConfig{"root": "rel"}}, ConfigError{"root": "must be absolute"}},
+		{"in data path", admin, &model.SyncLocation{Type: "local", Config: model.SyncConfig{"root": util.DataPath + "/1"}}, ConfigError{"root": "not allowed"}},
+		{"missing root", admin, &model.SyncLocation{Type: "local", Config: model.SyncConfig{"root": root + "/missing"}}, ConfigError{"root": "not writable"}},
+		{"valid", admin, &model.SyncLocation{Type: "local", Config: model.SyncConfig{"root": root}}, nil},
+	}
+	for _, tt := range tests {
+		s, err := SyncFromLocation(tt.u, tt.loc)
+		if !reflect.DeepEqual(err, tt.want) {
+			t.Errorf("%s: SyncFromLocation() error %v, want %v", tt.name, err, tt.want)
+		}
+		if err == nil {
+			if l, ok := s.(*Local); !ok || l.Root != root || l.Template != defaultLocalTemplate {
+				t.Errorf("%s: SyncFromLocation() = %+v", tt.name, s)
+			}
+		}
+	}
+
+	util.SyncLocalRoots = []string{root}
+	if _, err := SyncFromLocation(&model.User{}, &model.SyncLocation{Type: "local", Config: model.SyncConfig{"root": root + "/sub"}}); !reflect.DeepEqual(err, ConfigError{"root": "not writable"}) {
+		t.Errorf("SyncFromLocation() in roots error %v, want not writable", err)
+	}
+	if _, err := SyncFromLocation(&model.User{}, &model.SyncLocation{Type: "local", Config: model.SyncConfig{"root": t.TempDir()}}); !reflect.DeepEqual(err, ConfigError{"root": "not allowed"}) {
+		t.Errorf("SyncFromLocation() outside roots error %v, want not allowed", err)
+	}
+}
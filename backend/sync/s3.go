@@ -0,0 +1,382 @@
+package sync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+)
+
+type (
+	// S3 uploads originals to an S3 compatible bucket like AWS, MinIO or Backblaze B2
+	// under {prefix}{user}/{date}/{id}/{name}
+	S3 struct {
+		Endpoint  string `json:"endpoint"`
+		Region    string `json:"region"`
+		Bucket    string `json:"bucket"`
+		Prefix    string `json:"prefix"`
+		AccessKey string `json:"accessKey"`
+		SecretKey string `json:"secretKey"`
+		// PathStyle puts the bucket in the path instead of the host, MinIO needs it
+		PathStyle bool `json:"pathStyle"`
+	}
+
+	// s3Meta is stored in SyncMedia.Meta
+	s3Meta struct {
+		Key  string `json:"key"`
+		ETag string `json:"etag"`
+	}
+
+	s3Error struct {
+		Status  int
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	s3Part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+)
+
+const s3MaxParts = 10000
+
+var (
+	s3Client = &http.Client{Timeout: time.Hour}
+	// s3PartSize is where uploads switch to multipart, a single PUT is limited to 5 GB
+	s3PartSize int64 = 64 << 20
+)
+
+func init() {
+	Register(&Target{
+		Type: "s3",
+		Name: "S3 Compatible",
+		Fields: []Field{
+			{Name: "endpoint", Label: "Endpoint", Type: FieldString, Required: true, Check: checkURL, Description: "e.g. https://s3.us-east-1.amazonaws.com"},
+			{Name: "region", Label: "Region", Type: FieldString, Default: "us-east-1", Check: checkNoSpace},
+			{Name: "bucket", Label: "Bucket", Type: FieldString, Required: true, Check: checkNoSpace},
+			{Name: "prefix", Label: "Prefix", Type: FieldString, Description: "Added before each {user}/{date}/{id}/{name} key"},
+			{Name: "accessKey", Label: "Access Key", Type: FieldString, Required: true, Check: checkNoSpace},
+			{Name: "secretKey", Label: "Secret Key", Type: FieldPassword, Required: true},
+			{Name: "pathStyle", Label: "Path Style", Type: FieldBool, Default: false, Description: "Bucket in the path instead of the host, needed by MinIO"},
+		},
+		New: func() Sync { return &S3{} },
+	})
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 error %d %s %s", e.Status, e.Code, e.Message)
+}
+
+func (s *S3) Valid() bool {
+	if s.Endpoint == "" || s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+		return false
+	}
+	if _, err := url.ParseRequestURI(s.Endpoint); err != nil {
+		return false
+	}
+	resp, err := s.do(http.MethodHead, "", nil, nil, 0, "", emptySHA256)
+	if err != nil {
+		log.Println("s3 valid error", err)
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+func (s *S3) CanRetry(err error) bool {
+	if e, ok := err.(*s3Error); ok {
+		return e.Status >= 500 || e.Status == http.StatusTooManyRequests || e.Code == "SlowDown" || e.Code == "RequestTimeout"
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+func (s *S3) Upload(m *model.Media, path string) (string, error) {
+	rel, err := filepath.Rel(util.DataPath, path)
+	if err != nil {
+		return "", fmt.Errorf("S3 Upload rel error %v", err)
+	}
+	key := s.Prefix + filepath.ToSlash(rel)
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("S3 Upload open error %v", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("S3 Upload stat error %v", err)
+	}
+	var etag string
+	if fi.Size() > s3PartSize {
+		etag, err = s.uploadParts(key, file, fi.Size(), m.ContentType)
+	} else {
+		etag, err = s.put(key, nil, io.NewSectionReader(file, 0, fi.Size()), m.ContentType)
+	}
+	if err != nil {
+		return "", err
+	}
+	meta, err := json.Marshal(s3Meta{Key: key, ETag: etag})
+	if err != nil {
+		return "", err
+	}
+	return string(meta), nil
+}
+
+// put uploads an object or a part of one returning its etag,
+// the payload hash is signed so S3 rejects a corrupted upload
+func (s *S3) put(key string, query url.Values, r *io.SectionReader, cType string) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("S3 Upload hash error %v", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("S3 Upload seek error %v", err)
+	}
+	resp, err := s.do(http.MethodPut, key, query, r, r.Size(), cType, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+// uploadParts uploads a file over s3PartSize with a multipart upload, parts grow
+// when needed to stay within S3's limit and the upload is aborted when one fails
+func (s *S3) uploadParts(key string, file *os.File, size int64, cType string) (string, error) {
+	partSize := s3PartSize
+	if (size+partSize-1)/partSize > s3MaxParts {
+		partSize = (size + s3MaxParts - 1) / s3MaxParts
+	}
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0, cType, emptySHA256)
+	if err != nil {
+		return "", err
+	}
+	initiated := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return "", fmt.Errorf("S3 Upload initiate error %v", err)
+	}
+	upload := url.Values{"uploadId": {initiated.UploadID}}
+	etag, err := func() (string, error) {
+		var parts []s3Part
+		for off := int64(0); off < size; off += partSize {
+			n := partSize
+			if off+n > size {
+				n = size - off
+			}
+			query := url.Values{"partNumber": {fmt.Sprint(len(parts) + 1)}, "uploadId": upload["uploadId"]}
+			etag, err := s.put(key, query, io.NewSectionReader(file, off, n), "")
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s3Part{PartNumber: len(parts) + 1, ETag: `"` + etag + `"`})
+		}
+		body, err := xml.Marshal(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts   []s3Part `xml:"Part"`
+		}{Parts: parts})
+		if err != nil {
+			return "", err
+		}
+		resp, err := s.do(http.MethodPost, key, upload, strings.NewReader(string(body)), int64(len(body)), "application/xml", sha256Hex(body))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		// an error can come after the 200 status when completing takes a while
+		completed := struct {
+			XMLName xml.Name
+			ETag    string `xml:"ETag"`
+			s3Error
+		}{}
+		if err := xml.NewDecoder(resp.Body).Decode(&completed); err != nil {
+			return "", fmt.Errorf("S3 Upload complete error %v", err)
+		}
+		if completed.XMLName.Local == "Error" {
+			completed.s3Error.Status = resp.StatusCode
+			return "", &completed.s3Error
+		}
+		return strings.Trim(completed.ETag, `"`), nil
+	}()
+	if err != nil {
+		// parts of an unfinished upload are stored and billed until it's aborted
+		if resp, err := s.do(http.MethodDelete, key, upload, nil, 0, "", emptySHA256); err != nil {
+			log.Println("S3 Upload abort error", err)
+		} else {
+			resp.Body.Close()
+		}
+		return "", err
+	}
+	return etag, nil
+}
+
+func (s *S3) Delete(meta string) error {
+	sm := &s3Meta{}
+	if err := json.Unmarshal([]byte(meta), sm); err != nil || sm.Key == "" {
+		return fmt.Errorf("S3 Delete invalid meta %s", meta)
+	}
+	resp, err := s.do(http.MethodDelete, sm.Key, nil, nil, 0, "", emptySHA256)
+	if err != nil {
+		if e, ok := err.(*s3Error); ok && e.Status == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// objectURL is the bucket url when key is empty
+func (s *S3) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimRight(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	p := "/" + key
+	if s.PathStyle {
+		p = "/" + s.Bucket + p
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path += p
+	u.RawPath = s3Escape(u.Path, true)
+	return u, nil
+}
+
+// s3Escape encodes a path or a query value the way SigV4 canonical requests need it,
+// url.URL leaves characters like ( and ) that are common in file names as is
+func s3Escape(p string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query is the canonical query string of SigV4, sorted by key with every value encoded
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// do sends a signed request, responses that aren't 2xx are returned as *s3Error
+func (s *S3) do(method string, key string, query url.Values, body io.Reader, size int64, cType string, payloadHash string) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, fmt.Errorf("S3 url error %v", err)
+	}
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("S3 request error %v", err)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if cType != "" {
+		req.Header.Set("Content-Type", cType)
+	}
+	s.sign(req, payloadHash, time.Now())
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		e := &s3Error{Status: resp.StatusCode}
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(b, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to req
+func (s *S3) sign(req *http.Request, payloadHash string, t time.Time) {
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := t.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Content-Type") != "" {
+		signed = []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	}
+	var headers strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), amzDate[:8])
+	for _, v := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, strings.Join(signed, ";"), hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+var emptySHA256 = sha256Hex(nil)
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
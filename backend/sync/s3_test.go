@@ -0,0 +1,389 @@
+package sync
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+)
+
+// fakeS3 stores objects by host and escaped path after verifying each request's SigV4 signature
+type fakeS3 struct {
+	accessKey string
+	secretKey string
+	region    string
+
+	mu      stdsync.Mutex
+	objects map[string][]byte
+	hosts   []string
+	// errs are the requests rejected by verify
+	errs []error
+	// uploads are the parts of unfinished multipart uploads by id, failPart is rejected
+	uploads  map[string]map[int][]byte
+	nextID   int
+	failPart int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hosts = append(f.hosts, r.Host)
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := f.verify(r, body); err != nil {
+		f.errs = append(f.errs, fmt.Errorf("%s %s: %v", r.Method, r.URL.EscapedPath(), err))
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	key := r.Host + r.URL.EscapedPath()
+	query := r.URL.Query()
+	if _, ok := query["uploads"]; ok || query.Get("uploadId") != "" {
+		f.multipart(w, r, key, body)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		f.objects[key] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if _, ok := f.objects[key]; !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// multipart handles the requests of multipart uploads, ids have characters that need escaping in the query
+func (f *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	if f.uploads == nil {
+		f.uploads = make(map[string]map[int][]byte)
+	}
+	query := r.URL.Query()
+	id := query.Get("uploadId")
+	parts, ok := f.uploads[id]
+	if id != "" && !ok {
+		f.fail(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		f.nextID++
+		id = fmt.Sprintf("up/%d+id=", f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+	case r.Method == http.MethodPut:
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		if n == f.failPart {
+			f.fail(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		parts[n] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == http.MethodPost:
+		complete := struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}{}
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) != len(parts) {
+			f.fail(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		var object []byte
+		for i, p := range complete.Parts {
+			sum := md5.Sum(parts[p.PartNumber])
+			if p.PartNumber != i+1 || p.ETag != `"`+hex.EncodeToString(sum[:])+`"` {
+				f.fail(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, parts[p.PartNumber]...)
+		}
+		delete(f.uploads, id)
+		f.objects[key] = object
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>"multipart-%d"</ETag></CompleteMultipartUploadResult>`, len(parts))
+	case r.Method == http.MethodDelete:
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+// verify recomputes the signature from the request as the server received it
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	amzDate := r.Header.Get("X-Amz-Date")
+	t, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return fmt.Errorf("invalid X-Amz-Date %q", amzDate)
+	}
+	if d := time.Since(t); d > time.Minute || d < -time.Minute {
+		return fmt.Errorf("X-Amz-Date %s is not now", amzDate)
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != sha256Hex(body) {
+		return fmt.Errorf("X-Amz-Content-Sha256 %s doesn't match the body", payloadHash)
+	}
+	auth := r.Header.Get("Authorization")
+	const algo = "AWS4-HMAC-SHA256 "
+	if !strings.HasPrefix(auth, algo) {
+		return fmt.Errorf("invalid Authorization %q", auth)
+	}
+	parts := make(map[string]string)
+	for _, p := range strings.Split(strings.TrimPrefix(auth, algo), ", ") {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid Authorization %q", auth)
+		}
+		parts[kv[0]] = kv[1]
+	}
+	scope := amzDate[:8] + "/" + f.region + "/s3/aws4_request"
+	if want := f.accessKey + "/" + scope; parts["Credential"] != want {
+		return fmt.Errorf("Credential %s, want %s", parts["Credential"], want)
+	}
+	signed := strings.Split(parts["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) {
+		return fmt.Errorf("SignedHeaders %v not sorted", signed)
+	}
+	for _, h := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !strings.Contains(";"+parts["SignedHeaders"]+";", ";"+h+";") {
+			return fmt.Errorf("SignedHeaders %v is missing %s", signed, h)
+		}
+	}
+	var headers strings.Builder
+	for _, h := range signed {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, headers.String(), parts["SignedHeaders"], payloadHash}, "\n")
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := hmacSHA256([]byte("AWS4"+f.secretKey), amzDate[:8])
+	for _, v := range []string{f.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	if want := hex.EncodeToString(hmacSHA256(key, toSign)); parts["Signature"] != want {
+		return fmt.Errorf("Signature %s, want %s", parts["Signature"], want)
+	}
+	return nil
+}
+
+// testMedia writes a media file in a temporary DATA_PATH
+func testMedia(t *testing.T, userID int64, m *model.Media, content string) string {
+	dp := util.DataPath
+	util.DataPath = t.TempDir()
+	t.Cleanup(func() { util.DataPath = dp })
+	p := m.Path(userID)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestS3(t *testing.T) {
+	created, _ := time.Parse(util.DateTimeFormat, "2021-05-06 07:08:09")
+	m := &model.Media{ID: 42, Name: "IMG (1)+x.jpg", ContentType: "image/jpeg", Created: model.DateTime(created)}
+	tests := []struct {
+		name      string
+		pathStyle bool
+		region    string
+		host      string
+		path      string
+	}{
+		{"path style", true, "us-west-2", "s3.test", "/photos/backup/7/2021-05-06/42/IMG%20%281%29%2Bx.jpg"},
+		{"virtual host", false, "", "photos.s3.test", "/backup/7/2021-05-06/42/IMG%20%281%29%2Bx.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			region := tt.region
+			if region == "" {
+				region = "us-east-1"
+			}
+			fake := &fakeS3{accessKey: "AKID", secretKey: "secret/key", region: region, objects: make(map[string][]byte)}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			// every host resolves to the fake so virtual host urls can be checked
+			client := s3Client
+			s3Client = &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+				},
+			}}
+			defer func() { s3Client = client }()
+
+			p := testMedia(t, 7, m, "jpeg data")
+			s := &S3{Endpoint: "http://s3.test/", Region: tt.region, Bucket: "photos", Prefix: "backup/",
+				AccessKey: "AKID", SecretKey: "secret/key", PathStyle: tt.pathStyle}
+			if !s.Valid() {
+				t.Fatal("Valid() = false")
+			}
+			meta, err := s.Upload(m, p)
+			if err != nil {
+				t.Fatalf("Upload() error %v", err)
+			}
+			sm := &s3Meta{}
+			if err := json.Unmarshal([]byte(meta), sm); err != nil {
+				t.Fatalf("Upload() meta %s error %v", meta, err)
+			}
+			sum := md5.Sum([]byte("jpeg data"))
+			if want := "backup/7/2021-05-06/42/IMG (1)+x.jpg"; sm.Key != want {
+				t.Errorf("key = %s, want %s", sm.Key, want)
+			}
+			if want := hex.EncodeToString(sum[:]); sm.ETag != want {
+				t.Errorf("etag = %s, want %s", sm.ETag, want)
+			}
+			if got := string(fake.objects[tt.host+tt.path]); got != "jpeg data" {
+				t.Errorf("object %s%s = %q, stored %v", tt.host, tt.path, got, fake.objects)
+			}
+			for _, h := range fake.hosts {
+				if h != tt.host {
+					t.Errorf("request host = %s, want %s", h, tt.host)
+				}
+			}
+
+			if err := s.Delete(meta); err != nil {
+				t.Fatalf("Delete() error %v", err)
+			}
+			if len(fake.objects) != 0 {
+				t.Errorf("Delete() left %v", fake.objects)
+			}
+			// already deleted objects are fine
+			if err := s.Delete(meta); err != nil {
+				t.Errorf("Delete() missing error %v", err)
+			}
+			if err := s.Delete(`{}`); err == nil {
+				t.Error("Delete() invalid meta, want error")
+			}
+			for _, err := range fake.errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	fake := &fakeS3{accessKey: "AKID", secretKey: "secret", region: "us-east-1", objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	m := &model.Media{ID: 1, Name: "a.jpg", ContentType: "image/jpeg"}
+	p := testMedia(t, 1, m, "a")
+
+	bad := &S3{Endpoint: srv.URL, Bucket: "b", AccessKey: "AKID", SecretKey: "wrong", PathStyle: true}
+	_, err := bad.Upload(m, p)
+	e, ok := err.(*s3Error)
+	if !ok || e.Status != http.StatusForbidden || e.Code != "SignatureDoesNotMatch" {
+		t.Fatalf("Upload() error %v, want SignatureDoesNotMatch", err)
+	}
+	if len(fake.errs) != 1 || !strings.Contains(fake.errs[0].Error(), "Signature") {
+		t.Errorf("rejected %v, want a signature mismatch", fake.errs)
+	}
+	if bad.CanRetry(err) {
+		t.Error("CanRetry(403) = true")
+	}
+	for _, e := range []*s3Error{{Status: 500}, {Status: 503, Code: "SlowDown"}, {Status: 429}, {Status: 400, Code: "RequestTimeout"}} {
+		if !bad.CanRetry(e) {
+			t.Errorf("CanRetry(%v) = false", e)
+		}
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	created, _ := time.Parse(util.DateTimeFormat, "2021-05-06 07:08:09")
+	m := &model.Media{ID: 42, Name: "IMG (1).mp4", ContentType: "video/mp4", Created: model.DateTime(created)}
+	partSize := s3PartSize
+	s3PartSize = 4
+	defer func() { s3PartSize = partSize }()
+	tests := []struct {
+		name     string
+		failPart int
+		etag     string
+		object   bool
+	}{
+		{"complete", 0, "multipart-3", true},
+		{"failed part aborts", 2, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeS3{accessKey: "AKID", secretKey: "secret", region: "us-east-1", objects: make(map[string][]byte), failPart: tt.failPart}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			p := testMedia(t, 7, m, "0123456789")
+			s := &S3{Endpoint: srv.URL, Bucket: "photos", AccessKey: "AKID", SecretKey: "secret", PathStyle: true}
+			meta, err := s.Upload(m, p)
+			if (err == nil) != tt.object {
+				t.Fatalf("Upload() error %v", err)
+			}
+			key := strings.TrimPrefix(srv.URL, "http://") + "/photos/7/2021-05-06/42/IMG%20%281%29.mp4"
+			if got, ok := fake.objects[key]; ok != tt.object || (ok && string(got) != "0123456789") {
+				t.Errorf("object %s = %q %v, stored %v", key, got, ok, fake.objects)
+			}
+			if len(fake.uploads) != 0 {
+				t.Errorf("unfinished uploads %v", fake.uploads)
+			}
+			if tt.object {
+				sm := &s3Meta{}
+				if err := json.Unmarshal([]byte(meta), sm); err != nil || sm.ETag != tt.etag {
+					t.Errorf("Upload() meta %s error %v, want etag %s", meta, err, tt.etag)
+				}
+			} else if !s.CanRetry(err) {
+				t.Errorf("CanRetry(%v) = false", err)
+			}
+			for _, err := range fake.errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestS3Query(t *testing.T) {
+	tests := []struct {
+		query url.Values
+		want  string
+	}{
+		{nil, ""},
+		{url.Values{"uploads": {""}}, "uploads="},
+		{url.Values{"uploadId": {"a/b+c= d"}, "partNumber": {"2"}}, "partNumber=2&uploadId=a%2Fb%2Bc%3D%20d"},
+	}
+	for _, tt := range tests {
+		if got := s3Query(tt.query); got != tt.want {
+			t.Errorf("s3Query(%v) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type (
+	// SFTP uploads originals to a server over SSH under {folder}/{date}/{id}_{name},
+	// a relative folder is from the login directory. HostKey pins the server key either
+	// as a known_hosts style "ssh-ed25519 AAAA..." key or a "SHA256:..." fingerprint,
+	// any key is only accepted without it when InsecureSkipHostKey is set
+	SFTP struct {
+		Host                string `json:"host"`
+		Username            string `json:"username"`
+		Password            string `json:"password"`
+		PrivateKey          string `json:"privateKey"`
+		Passphrase          string `json:"passphrase"`
+		HostKey             string `json:"hostKey"`
+		InsecureSkipHostKey bool   `json:"insecureSkipHostKey"`
+		Folder              string `json:"folder"`
+
+		// conn is kept from Valid until Close so a sync run uses one connection
+		conn *sftpConn
+	}
+
+	// sftpConn is an SFTP session and the SSH connection it runs on
+	sftpConn struct {
+		*sftp.Client
+		conn *ssh.Client
+	}
+)
+
+func init() {
+	Register(&Target{
+		Type: "sftp",
+		Name: "SFTP",
+		Fields: []Field{
+			{Name: "host", Label: "Host", Type: FieldString, Required: true, Check: checkNoSpace, Description: "host or host:port, port 22 by default"},
+			{Name: "username", Label: "Username", Type: FieldString, Required: true},
+			{Name: "password", Label: "Password", Type: FieldPassword},
+			{Name: "privateKey", Label: "Private Key", Type: FieldText, Description: "PEM or OpenSSH private key, used instead of or with the password"},
+			{Name: "passphrase", Label: "Passphrase", Type: FieldPassword},
+			{Name: "hostKey", Label: "Host Key", Type: FieldString, Description: "Server public key or its SHA256: fingerprint, the error shows it when empty"},
+			{Name: "insecureSkipHostKey", Label: "Skip Host Key", Type: FieldBool, Default: false, Description: "Accept any server key without a host key, anyone in between can read the files"},
+			{Name: "folder", Label: "Folder", Type: FieldString, Description: "Files are stored as {folder}/{date}/{id}_{name}"},
+		},
+		New: func() Sync { return &SFTP{} },
+		Validate: func(c model.SyncConfig) ConfigError {
+			errs := make(ConfigError)
+			key, _ := c["privateKey"].(string)
+			if password, _ := c["password"].(string); password == "" && key == "" {
+				errs["password"] = "required"
+			}
+			if key != "" {
+				passphrase, _ := c["passphrase"].(string)
+				if _, err := parsePrivateKey(key, passphrase); err != nil {
+					if _, ok := err.(*ssh.PassphraseMissingError); ok {
+						errs["passphrase"] = "required"
+					} else if err == x509.IncorrectPasswordError {
+						errs["passphrase"] = "invalid"
+					} else {
+						errs["privateKey"] = "invalid"
+					}
+				}
+			}
+			pinned, _ := c["hostKey"].(string)
+			if pinned != "" && !strings.HasPrefix(pinned, "SHA256:") {
+				if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pinned)); err != nil {
+					errs["hostKey"] = "invalid"
+				}
+			}
+			if skip, _ := c["insecureSkipHostKey"].(bool); pinned == "" && !skip && len(errs) == 0 {
+				// the fingerprint is shown so it can be checked with the server's admin and pinned
+				if fp, err := hostKeyFingerprint(c["host"].(string)); err == nil {
+					errs["hostKey"] = "required, server key is " + fp
+				} else {
+					errs["hostKey"] = "required"
+				}
+			}
+			return errs
+		},
+	})
+}
+
+func (s *SFTP) Valid() bool {
+	if s.Host == "" || s.Username == "" || (s.Password == "" && s.PrivateKey == "") {
+		return false
+	}
+	c, err := s.client()
+	if err != nil {
+		log.Println("sftp valid error", err)
+		return false
+	}
+	if _, err := c.RealPath("."); err != nil {
+		log.Println("sftp valid realpath error", err)
+		s.Close()
+		return false
+	}
+	return true
+}
+
+// Close ends the connection kept between calls
+func (s *SFTP) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// CanRetry is false when the server refused the operation or the original is gone,
+// connection errors are retried
+func (s *SFTP) CanRetry(err error) bool {
+	return err != errNoOriginal && !os.IsPermission(err) && !os.IsNotExist(err)
+}
+
+// Upload writes to a temp name next to the destination then renames it
+func (s *SFTP) Upload(m *model.Media, p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errNoOriginal
+		}
+		return "", fmt.Errorf("SFTP Upload open error %v", err)
+	}
+	defer file.Close()
+	c, err := s.client()
+	if err != nil {
+		return "", err
+	}
+	dir := path.Join(s.Folder, time.Time(m.Created).Format(util.DateFormat))
+	if err := c.MkdirAll(dir); err != nil {
+		return "", s.drop(err)
+	}
+	name := util.I64toa(m.ID) + "_" + m.Name
+	remote := path.Join(dir, name)
+	tmp := path.Join(dir, "."+name+".tmp")
+	if err := c.writeFile(tmp, file); err != nil {
+		return "", s.drop(err)
+	}
+	if err := c.rename(tmp, remote); err != nil {
+		c.Remove(tmp)
+		return "", s.drop(err)
+	}
+	return remote, nil
+}
+
+func (s *SFTP) Delete(meta string) error {
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+	if err := c.Remove(meta); err != nil && !os.IsNotExist(err) {
+		return s.drop(err)
+	}
+	return nil
+}
+
+// client returns the kept connection or makes it
+func (s *SFTP) client() (*sftpConn, error) {
+	if s.conn == nil {
+		c, err := s.connect()
+		if err != nil {
+			return nil, err
+		}
+		s.conn = c
+	}
+	return s.conn, nil
+}
+
+// drop closes the connection after an error that may have broken it so a retry reconnects
+func (s *SFTP) drop(err error) error {
+	if s.CanRetry(err) {
+		s.Close()
+	}
+	return err
+}
+
+func (s *SFTP) hostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fp := ssh.FingerprintSHA256(key)
+		pinned := strings.TrimSpace(s.HostKey)
+		if pinned == "" {
+			if s.InsecureSkipHostKey {
+				return nil
+			}
+			return fmt.Errorf("sftp host key %s is not pinned, set hostKey to it", fp)
+		}
+		if strings.HasPrefix(pinned, "SHA256:") {
+			if pinned == fp {
+				return nil
+			}
+		} else if pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pinned)); err == nil && bytes.Equal(pk.Marshal(), key.Marshal()) {
+			return nil
+		}
+		return fmt.Errorf("sftp host key %s doesn't match the pinned key", fp)
+	}
+}
+
+// hostKeyFingerprint is the SHA256 fingerprint of the server key, the handshake stops once it's known
+func hostKeyFingerprint(host string) (string, error) {
+	var fp string
+	errKnown := fmt.Errorf("host key known")
+	_, err := ssh.Dial("tcp", sftpAddr(host), &ssh.ClientConfig{
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fp = ssh.FingerprintSHA256(key)
+			return errKnown
+		},
+		Timeout: 30 * time.Second,
+	})
+	if fp == "" {
+		return "", err
+	}
+	return fp, nil
+}
+
+// sftpAddr adds the default port to host
+func sftpAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return net.JoinHostPort(host, "22")
+	}
+	return host
+}
+
+func parsePrivateKey(key string, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(passphrase))
+	}
+	return ssh.ParsePrivateKey([]byte(key))
+}
+
+func (s *SFTP) connect() (*sftpConn, error) {
+	var auth []ssh.AuthMethod
+	if s.PrivateKey != "" {
+		signer, err := parsePrivateKey(s.PrivateKey, s.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("SFTP private key error %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if s.Password != "" {
+		auth = append(auth, ssh.Password(s.Password))
+	}
+	client, err := ssh.Dial("tcp", sftpAddr(s.Host), &ssh.ClientConfig{
+		User:            s.Username,
+		Auth:            auth,
+		HostKeyCallback: s.hostKeyCallback(),
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// writes of a file are sent without waiting for each one so latency doesn't limit throughput
+	sc, err := sftp.NewClient(client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &sftpConn{Client: sc, conn: client}, nil
+}
+
+func (c *sftpConn) Close() error {
+	c.Client.Close()
+	return c.conn.Close()
+}
+
+// writeFile copies r to p, replacing what's there
+func (c *sftpConn) writeFile(p string, r io.Reader) error {
+	f, err := c.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := f.ReadFrom(r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rename replaces newPath, plain SFTP rename fails when it exists
+func (c *sftpConn) rename(oldPath string, newPath string) error {
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		return c.PosixRename(oldPath, newPath)
+	}
+	if err := c.Remove(newPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return c.Rename(oldPath, newPath)
+}
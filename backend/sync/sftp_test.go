@@ -0,0 +1,303 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSH is an SSH server with the sftp subsystem serving root, it takes the password pw
+// or the user key for the user bob
+type fakeSSH struct {
+	addr    string
+	root    string
+	hostKey ssh.Signer
+	userKey ed25519.PrivateKey
+	// conns is how many connections were accepted
+	conns int32
+}
+
+func newFakeSSH(t *testing.T) *fakeSSH {
+	f := &fakeSSH{root: t.TempDir()}
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.hostKey, err = ssh.NewSignerFromKey(hostKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, f.userKey, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	userPub, err := ssh.NewPublicKey(f.userKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "bob" && string(pass) == "pw" {
+				return nil, nil
+			}
+			return nil, errors.New("denied")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "bob" && bytes.Equal(key.Marshal(), userPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("denied")
+		},
+	}
+	cfg.AddHostKey(f.hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f.addr = l.Addr().String()
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&f.conns, 1)
+			go f.serve(nc, cfg)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSSH) serve(nc net.Conn, cfg *ssh.ServerConfig) {
+	defer nc.Close()
+	_, chans, reqs, err := ssh.NewServerConn(nc, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		ch, in, err := nch.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer ch.Close()
+			for req := range in {
+				// the payload is the subsystem name as an ssh string
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					srv, err := sftp.NewServer(ch, sftp.WithServerWorkingDirectory(f.root))
+					if err != nil {
+						return
+					}
+					srv.Serve()
+					return
+				}
+			}
+		}()
+	}
+}
+
+// privateKey is the user key as an encrypted OpenSSH PEM
+func (f *fakeSSH) privateKey(t *testing.T, passphrase string) string {
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(f.userKey, "", []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(block))
+}
+
+func TestSFTPValid(t *testing.T) {
+	fake := newFakeSSH(t)
+	fp := ssh.FingerprintSHA256(fake.hostKey.PublicKey())
+	other, _ := ssh.NewSignerFromKey(fake.userKey)
+	tests := []struct {
+		name string
+		s    *SFTP
+		want bool
+	}{
+		{"password", &SFTP{Host: fake.addr, Username: "bob", Password: "pw", HostKey: fp}, true},
+		{"pinned key", &SFTP{Host: fake.addr, Username: "bob", Password: "pw", HostKey: string(ssh.MarshalAuthorizedKey(fake.hostKey.PublicKey()))}, true},
+		{"private key", &SFTP{Host: fake.addr, Username: "bob", PrivateKey: fake.privateKey(t, "secret"), Passphrase: "secret", HostKey: fp}, true},
+		{"wrong password", &SFTP{Host: fake.addr, Username: "bob", Password: "no", HostKey: fp}, false},
+		{"wrong passphrase", &SFTP{Host: fake.addr, Username: "bob", PrivateKey: fake.privateKey(t, "secret"), Passphrase: "no", HostKey: fp}, false},
+		{"other fingerprint", &SFTP{Host: fake.addr, Username: "bob", Password: "pw", HostKey: "SHA256:AAAA"}, false},
+		{"other key", &SFTP{Host: fake.addr, Username: "bob", Password: "pw", HostKey: string(ssh.MarshalAuthorizedKey(other.PublicKey()))}, false},
+		{"no auth", &SFTP{Host: fake.addr, Username: "bob", HostKey: fp}, false},
+		{"not pinned", &SFTP{Host: fake.addr, Username: "bob", Password: "pw"}, false},
+		{"insecure", &SFTP{Host: fake.addr, Username: "bob", Password: "pw", InsecureSkipHostKey: true}, true},
+		{"insecure other key", &SFTP{Host: fake.addr, Username: "bob", Password: "pw", HostKey: "SHA256:AAAA", InsecureSkipHostKey: true}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.s.Valid(); got != tt.want {
+			t.Errorf("%s: Valid() = %v, want %v", tt.name, got, tt.want)
+		}
+		tt.s.Close()
+	}
+}
+
+func TestSFTPHostKey(t *testing.T) {
+	fake := newFakeSSH(t)
+	fp := ssh.FingerprintSHA256(fake.hostKey.PublicKey())
+	target := targets["sftp"]
+	conf := model.SyncConfig{"host": fake.addr, "username": "bob", "password": "pw"}
+	errs := target.check(conf)
+	if want := "required, server key is " + fp; errs["hostKey"] != want {
+		t.Errorf("check() without hostKey = %v, want hostKey %s", errs, want)
+	}
+	_, err := (&SFTP{Host: fake.addr, Username: "bob", Password: "pw"}).connect()
+	if err == nil || !strings.Contains(err.Error(), fp) {
+		t.Errorf("connect() without hostKey error %v, want the fingerprint", err)
+	}
+
+	conf["hostKey"] = fp
+	if errs := target.check(conf); errs != nil {
+		t.Errorf("check() pinned = %v", errs)
+	}
+	delete(conf, "hostKey")
+	conf["insecureSkipHostKey"] = true
+	if errs := target.check(conf); errs != nil {
+		t.Errorf("check() insecure = %v", errs)
+	}
+
+	// a server that can't be reached still needs the key
+	conf = model.SyncConfig{"host": "127.0.0.1:1", "username": "bob", "password": "pw"}
+	if errs := target.check(conf); errs["hostKey"] != "required" {
+		t.Errorf("check() unreachable = %v, want hostKey required", errs)
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	fake := newFakeSSH(t)
+	created, _ := time.Parse(util.DateTimeFormat, "2021-05-06 07:08:09")
+	m := &model.Media{ID: 42, Name: "a (1).jpg", Created: model.DateTime(created)}
+	// large enough for many concurrent writes
+	data := make([]byte, 3*1024*1024+17)
+	rand.Read(data)
+	p := testMedia(t, 7, m, string(data))
+
+	s := &SFTP{Host: fake.addr, Username: "bob", Password: "pw", Folder: "photos/backup",
+		HostKey: ssh.FingerprintSHA256(fake.hostKey.PublicKey())}
+	defer s.Close()
+	meta, err := s.Upload(m, p)
+	if err != nil {
+		t.Fatalf("Upload() error %v", err)
+	}
+	if want := "photos/backup/2021-05-06/42_a (1).jpg"; meta != want {
+		t.Errorf("Upload() meta = %s, want %s", meta, want)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(fake.root, meta))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("uploaded %d bytes error %v, want %d", len(got), err, len(data))
+	}
+
+	// uploading again replaces the file without leaving the temp one
+	if err := ioutil.WriteFile(p, []byte("smaller"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Upload(m, p); err != nil {
+		t.Fatalf("Upload() again error %v", err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(fake.root, meta)); string(got) != "smaller" {
+		t.Errorf("uploaded again %q, want smaller", got)
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(filepath.Join(fake.root, meta)))
+	if len(files) != 1 {
+		t.Errorf("folder has %d files, want 1", len(files))
+	}
+
+	if err := s.Delete(meta); err != nil {
+		t.Fatalf("Delete() error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fake.root, meta)); !os.IsNotExist(err) {
+		t.Errorf("Delete() left the file, stat error %v", err)
+	}
+	// already deleted files are fine
+	if err := s.Delete(meta); err != nil {
+		t.Errorf("Delete() missing error %v", err)
+	}
+
+	_, err = s.Upload(m, filepath.Join(util.DataPath, "missing.jpg"))
+	if err != errNoOriginal || s.CanRetry(err) {
+		t.Errorf("Upload() missing original error %v retry %v", err, s.CanRetry(err))
+	}
+	for _, err := range []error{os.ErrPermission, os.ErrNotExist, &os.PathError{Op: "open", Path: "a", Err: os.ErrPermission}} {
+		if s.CanRetry(err) {
+			t.Errorf("CanRetry(%v) = true", err)
+		}
+	}
+	if !s.CanRetry(&net.OpError{Op: "dial", Err: errors.New("refused")}) {
+		t.Error("CanRetry(dial error) = false")
+	}
+}
+
+func TestSFTPConnection(t *testing.T) {
+	fake := newFakeSSH(t)
+	created, _ := time.Parse(util.DateTimeFormat, "2021-05-06 07:08:09")
+	m := &model.Media{ID: 1, Name: "a.jpg", Created: model.DateTime(created)}
+	p := testMedia(t, 7, m, "a")
+	s := &SFTP{Host: fake.addr, Username: "bob", Password: "pw", HostKey: ssh.FingerprintSHA256(fake.hostKey.PublicKey())}
+
+	// a run validates, uploads and deletes over the connection Valid made
+	if !s.Valid() {
+		t.Fatal("Valid() = false")
+	}
+	var metas []string
+	for i := 0; i < 3; i++ {
+		meta, err := s.Upload(m, p)
+		if err != nil {
+			t.Fatalf("Upload() error %v", err)
+		}
+		metas = append(metas, meta)
+	}
+	for _, meta := range metas {
+		if err := s.Delete(meta); err != nil {
+			t.Fatalf("Delete() error %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&fake.conns); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close() error %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close() again error %v", err)
+	}
+
+	// a broken connection fails the call then the retry reconnects
+	if _, err := s.Upload(m, p); err != nil {
+		t.Fatalf("Upload() after Close error %v", err)
+	}
+	s.conn.conn.Close()
+	_, err := s.Upload(m, p)
+	if err == nil || !s.CanRetry(err) {
+		t.Fatalf("Upload() broken connection error %v retry %v", err, s.CanRetry(err))
+	}
+	if _, err := s.Upload(m, p); err != nil {
+		t.Fatalf("Upload() retry error %v", err)
+	}
+	s.Close()
+	if n := atomic.LoadInt32(&fake.conns); n != 3 {
+		t.Errorf("%d connections, want 3", n)
+	}
+}
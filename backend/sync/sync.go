@@ -2,7 +2,9 @@ package sync
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"sync"
 	"time"
 
@@ -10,10 +12,13 @@ import (
 )
 
 type (
+	// Sync is a sync target, one that keeps a connection between calls also implements io.Closer
+	// which is called after each run
 	Sync interface {
 		Valid() bool
 		CanRetry(error) bool
-		Upload(cType string, path string) (string, error)
+		// Upload copies the original of m at path, the returned meta is what Delete gets
+		Upload(m *model.Media, path string) (string, error)
 		Delete(meta string) error
 	}
 )
@@ -21,7 +26,7 @@ type (
 var (
 	SyncChannel = make(chan int64)
 	ErrType     = fmt.Errorf("invalid type")
-	ErrConfig   = fmt.Errorf("invlid config")
+	ErrConfig   = fmt.Errorf("invalid config")
 
 	locks sync.Map
 )
@@ -35,6 +40,10 @@ func syncListener() {
 }
 
 func Init() {
+	model.RegisterJob(model.JobSync, func(u *model.User, j *model.Job) error {
+		ScheduleSync(u.ID)
+		return nil
+	})
 	go syncListener()
 
 	users, err := model.GetUsers()
@@ -54,23 +63,32 @@ func ScheduleSync(userID int64) {
 	SyncChannel <- userID
 }
 
-func SyncFromLocation(loc *model.SyncLocation) (Sync, error) {
-	var syncer Sync
-	if loc.Type == "telegram" {
-		syncer = &Telegram{
-			Token:   loc.Config["token"].(string),
-			Channel: loc.Config["channel"].(string),
-		}
-	}
-	if syncer == nil {
+// SyncFromLocation returns the syncer of a location for its user, a ConfigError has the invalid fields
+// and ErrConfig is returned when the target rejects a valid looking config
+func SyncFromLocation(u *model.User, loc *model.SyncLocation) (Sync, error) {
+	t, ok := targets[loc.Type]
+	if !ok || !t.allowed(u) {
 		return nil, ErrType
-	} else if !syncer.Valid() {
+	}
+	if errs := t.check(loc.Config); errs != nil {
+		return nil, errs
+	}
+	syncer, err := t.syncer(loc.Config)
+	if err != nil {
+		return nil, err
+	}
+	if !syncer.Valid() {
 		return nil, ErrConfig
 	}
 	return syncer, nil
 }
 
 func SyncUser(userID int64) {
+	u, err := model.GetUser(userID, "")
+	if err != nil {
+		log.Printf("SyncUser error get user %v", err)
+		return
+	}
 	locs, err := model.GetSyncs(userID, true)
 	if err != nil {
 		log.Printf("SyncUser error get syncs %v", err)
@@ -78,12 +96,12 @@ func SyncUser(userID int64) {
 	}
 
 	for _, loc := range locs {
-		syncer, err := SyncFromLocation(&loc)
+		syncer, err := SyncFromLocation(u, &loc)
 		if err == ErrType {
 			log.Println("SyncUser", userID, "location type", loc.Type, "invalid")
 			continue
-		} else if err == ErrConfig {
-			log.Println("SyncUser", userID, "invalid config", loc.Name)
+		} else if err != nil {
+			log.Println("SyncUser", userID, "invalid config", loc.Name, err)
 			continue
 		}
 		go SyncLocation(userID, &loc, syncer)
@@ -91,6 +109,9 @@ func SyncUser(userID int64) {
 }
 
 func SyncLocation(userID int64, loc *model.SyncLocation, syncer Sync) {
+	if c, ok := syncer.(io.Closer); ok {
+		defer c.Close()
+	}
 	key := fmt.Sprintf("%d/%d", userID, loc.ID)
 	lock, _ := locks.LoadOrStore(key, &sync.Mutex{})
 	mu := lock.(*sync.Mutex)
@@ -117,8 +138,13 @@ func SyncLocation(userID int64, loc *model.SyncLocation, syncer Sync) {
 			meta string
 			err  error
 		)
+		// a missing original isn't recorded so it's synced once it's back
+		if _, err := os.Stat(m.Path(userID)); err != nil {
+			log.Println("SyncLocation[", userID, "][", loc.ID, loc.Name, "] skip", m.ID, "original error", err)
+			continue
+		}
 		for i := 0; i < 3; i++ {
-			meta, err = syncer.Upload(m.ContentType, m.Path(userID))
+			meta, err = syncer.Upload(&m, m.Path(userID))
 			if err != nil {
 				if syncer.CanRetry(err) {
 					log.Println("SyncLocation[", userID, "][", loc.ID, loc.Name, "] upload", m.ID, "error", err, "retrying in 1 minute x", i)
@@ -0,0 +1,117 @@
+//go:build json1 && fts5
+// +build json1,fts5
+
+package sync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+)
+
+// exifJPEG is a small JPEG with an EXIF DateTime of dt
+func exifJPEG(t *testing.T, dt string) []byte {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// one ascii DateTime entry in IFD0 with its value after the IFD
+	var tiff bytes.Buffer
+	le := binary.LittleEndian
+	tiff.WriteString("II*\x00")
+	binary.Write(&tiff, le, uint32(8))
+	binary.Write(&tiff, le, uint16(1))
+	binary.Write(&tiff, le, []uint16{0x0132, 2})
+	binary.Write(&tiff, le, []uint32{uint32(len(dt) + 1), 26})
+	binary.Write(&tiff, le, uint32(0))
+	tiff.WriteString(dt + "\x00")
+	var b bytes.Buffer
+	b.Write(img.Bytes()[:2])
+	b.Write([]byte{0xFF, 0xE1})
+	binary.Write(&b, binary.BigEndian, uint16(2+6+tiff.Len()))
+	b.WriteString("Exif\x00\x00")
+	b.Write(tiff.Bytes())
+	b.Write(img.Bytes()[2:])
+	return b.Bytes()
+}
+
+func pendingMedia(t *testing.T, userID int64, loc *model.SyncLocation) []model.Media {
+	medias, _, err := model.GetMediaToSync(userID, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return medias
+}
+
+func TestSyncAfterProbe(t *testing.T) {
+	dp := util.DataPath
+	util.DataPath = t.TempDir()
+	t.Cleanup(func() { util.DataPath = dp })
+
+	u := &model.User{Name: "test", IsAdmin: true, Active: true}
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	loc := &model.SyncLocation{Name: "mirror", Type: "local", Config: model.SyncConfig{"root": root}}
+	if err := loc.Save(u); err != nil {
+		t.Fatal(err)
+	}
+	Init()
+
+	id, err := u.AddMedia("a.jpg", "image/jpeg", bytes.NewReader(exifJPEG(t, "2019:02:03 04:05:06")), "2020-01-01 00:00:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the probe can still move it to its EXIF date
+	SyncLocation(u.ID, loc, &Local{Root: root})
+	if medias := pendingMedia(t, u.ID, loc); len(medias) != 0 {
+		t.Fatalf("GetMediaToSync() before probe = %d media, want 0", len(medias))
+	}
+	if files, _ := filepath.Glob(filepath.Join(root, "*")); len(files) != 0 {
+		t.Fatalf("synced before probe %v", files)
+	}
+
+	go model.StartJobWorkers(1)
+	mirrored := filepath.Join(root, util.I64toa(u.ID), "2019", "02", "a.jpg")
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		if _, err := os.Stat(mirrored); err == nil {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("%s not synced after probe", mirrored)
+		}
+	}
+	m, err := u.GetMediaByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chk, err := fileSHA1(mirrored); err != nil || chk != m.Checksum {
+		t.Errorf("mirrored checksum = %s %v, want %s", chk, err, m.Checksum)
+	}
+
+	// a missing original stays pending instead of being recorded as synced
+	if err := os.Remove(m.Path(u.ID)); err != nil {
+		t.Fatal(err)
+	}
+	root2 := t.TempDir()
+	loc2 := &model.SyncLocation{Name: "mirror2", Type: "local", Config: model.SyncConfig{"root": root2}}
+	if err := loc2.Save(u); err != nil {
+		t.Fatal(err)
+	}
+	SyncLocation(u.ID, loc2, &Local{Root: root2})
+	if files, _ := filepath.Glob(filepath.Join(root2, "*")); len(files) != 0 {
+		t.Errorf("synced a missing original %v", files)
+	}
+	if medias := pendingMedia(t, u.ID, loc2); len(medias) != 1 || medias[0].ID != id {
+		t.Errorf("GetMediaToSync() after missing original = %d media, want %d pending", len(medias), id)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/altlimit/dmedia/model"
 	"github.com/tidwall/gjson"
 )
 
@@ -21,6 +22,18 @@ type Telegram struct {
 	Channel string `json:"channel"`
 }
 
+func init() {
+	Register(&Target{
+		Type: "telegram",
+		Name: "Telegram",
+		Fields: []Field{
+			{Name: "token", Label: "Bot Token", Type: FieldPassword, Required: true, Check: checkNoSpace},
+			{Name: "channel", Label: "Channel", Type: FieldString, Required: true, Description: "Chat id or @channelusername the bot can post to"},
+		},
+		New: func() Sync { return &Telegram{} },
+	})
+}
+
 func (t *Telegram) Valid() bool {
 	if t.Token != "" && t.Channel != "" {
 		resp, err := http.Get(t.getURL("getMe"))
@@ -47,7 +60,8 @@ func (t *Telegram) getURL(method string) string {
 	return fmt.Sprintf("https://api.telegram.org/bot%s/%s", t.Token, method)
 }
 
-func (t *Telegram) Upload(cType string, path string) (string, error) {
+func (t *Telegram) Upload(m *model.Media, path string) (string, error) {
+	cType := m.ContentType
 	form := map[string]string{"chat_id": t.Channel}
 	var (
 		field  string
@@ -0,0 +1,181 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+)
+
+type (
+	// WebDAV uploads originals to a WebDAV server like Nextcloud or ownCloud
+	// under {folder}/{date}/{id}_{name}, URL is the user's files root
+	// e.g. https://cloud.example.com/remote.php/dav/files/{username}
+	WebDAV struct {
+		URL      string `json:"url"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Folder   string `json:"folder"`
+
+		// collections already made by this instance
+		dirs map[string]bool
+	}
+
+	webdavError struct {
+		Method string
+		Status int
+	}
+)
+
+var (
+	webdavClient = &http.Client{Timeout: time.Hour}
+)
+
+func init() {
+	Register(&Target{
+		Type: "webdav",
+		Name: "WebDAV",
+		Fields: []Field{
+			{Name: "url", Label: "URL", Type: FieldString, Required: true, Check: checkURL, Description: "Files root e.g. https://cloud.example.com/remote.php/dav/files/{username}"},
+			{Name: "username", Label: "Username", Type: FieldString},
+			{Name: "password", Label: "Password", Type: FieldPassword},
+			{Name: "folder", Label: "Folder", Type: FieldString, Description: "Files are stored as {folder}/{date}/{id}_{name}"},
+		},
+		New: func() Sync { return &WebDAV{} },
+	})
+}
+
+func (e *webdavError) Error() string {
+	return fmt.Sprintf("webdav %s error %d", e.Method, e.Status)
+}
+
+func (w *WebDAV) Valid() bool {
+	if w.URL == "" {
+		return false
+	}
+	if _, err := url.ParseRequestURI(w.URL); err != nil {
+		return false
+	}
+	body := `<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`
+	resp, err := w.do("PROPFIND", "", strings.NewReader(body), int64(len(body)), map[string]string{
+		"Depth":        "0",
+		"Content-Type": "application/xml",
+	})
+	if err != nil {
+		log.Println("webdav valid error", err)
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+func (w *WebDAV) CanRetry(err error) bool {
+	if e, ok := err.(*webdavError); ok {
+		return e.Status >= 500 || e.Status == http.StatusTooManyRequests || e.Status == http.StatusLocked
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+func (w *WebDAV) Upload(m *model.Media, path string) (string, error) {
+	dir := strings.Trim(w.Folder, "/")
+	if dir != "" {
+		dir += "/"
+	}
+	dir += time.Time(m.Created).Format(util.DateFormat)
+	if err := w.mkdirAll(dir); err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("WebDAV Upload open error %v", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("WebDAV Upload stat error %v", err)
+	}
+	remote := dir + "/" + util.I64toa(m.ID) + "_" + m.Name
+	resp, err := w.do(http.MethodPut, remote, file, fi.Size(), map[string]string{"Content-Type": m.ContentType})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return remote, nil
+}
+
+func (w *WebDAV) Delete(meta string) error {
+	resp, err := w.do(http.MethodDelete, meta, nil, 0, nil)
+	if err != nil {
+		if e, ok := err.(*webdavError); ok && e.Status == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// mkdirAll makes every missing collection of dir, MKCOL on an existing one is a 405
+func (w *WebDAV) mkdirAll(dir string) error {
+	if w.dirs == nil {
+		w.dirs = make(map[string]bool)
+	}
+	var p string
+	for _, part := range strings.Split(dir, "/") {
+		p += part + "/"
+		if w.dirs[p] {
+			continue
+		}
+		resp, err := w.do("MKCOL", p, nil, 0, nil)
+		if err != nil {
+			if e, ok := err.(*webdavError); !ok || e.Status != http.StatusMethodNotAllowed {
+				return err
+			}
+		} else {
+			resp.Body.Close()
+		}
+		w.dirs[p] = true
+	}
+	return nil
+}
+
+// do sends a request for a path relative to URL, responses that aren't 2xx are returned as *webdavError
+func (w *WebDAV) do(method string, p string, body io.Reader, size int64, headers map[string]string) (*http.Response, error) {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(w.URL, "/")+"/"+strings.Join(segments, "/"), body)
+	if err != nil {
+		return nil, fmt.Errorf("WebDAV request error %v", err)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if w.Username != "" {
+		req.SetBasicAuth(w.Username, w.Password)
+	}
+	resp, err := webdavClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		return nil, &webdavError{Method: method, Status: resp.StatusCode}
+	}
+	return resp, nil
+}
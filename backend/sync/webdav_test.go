@@ -0,0 +1,178 @@
+package sync
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	"github.com/altlimit/dmedia/model"
+	"github.com/altlimit/dmedia/util"
+	"golang.org/x/net/webdav"
+)
+
+// fakeDAV is a WebDAV server that needs basic auth and counts the statuses of each method
+type fakeDAV struct {
+	fs       webdav.FileSystem
+	handler  *webdav.Handler
+	mu       stdsync.Mutex
+	statuses map[string][]int
+}
+
+func newFakeDAV() *fakeDAV {
+	f := &fakeDAV{fs: webdav.NewMemFS(), statuses: make(map[string][]int)}
+	f.handler = &webdav.Handler{
+		Prefix:     "/dav/files/u",
+		FileSystem: f.fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+	return f
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (f *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != "u" || pass != "p" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	f.handler.ServeHTTP(sw, r)
+	f.mu.Lock()
+	f.statuses[r.Method] = append(f.statuses[r.Method], sw.status)
+	f.mu.Unlock()
+}
+
+func (f *fakeDAV) read(t *testing.T, name string) (string, bool) {
+	file, err := f.fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), true
+}
+
+func count(statuses []int, status int) int {
+	var n int
+	for _, s := range statuses {
+		if s == status {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWebDAV(t *testing.T) {
+	fake := newFakeDAV()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	created, _ := time.Parse(util.DateTimeFormat, "2021-05-06 07:08:09")
+	m1 := &model.Media{ID: 1, Name: "IMG #1 (a).jpg", ContentType: "image/jpeg", Created: model.DateTime(created)}
+	m2 := &model.Media{ID: 2, Name: "b.jpg", ContentType: "image/jpeg", Created: model.DateTime(created)}
+	p1 := testMedia(t, 7, m1, "first")
+	p2 := m2.Path(7)
+	if err := os.MkdirAll(filepath.Dir(p2), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p2, []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if (&WebDAV{URL: srv.URL + "/dav/files/u", Username: "u", Password: "wrong"}).Valid() {
+		t.Error("Valid() with a wrong password = true")
+	}
+	w := &WebDAV{URL: srv.URL + "/dav/files/u/", Username: "u", Password: "p", Folder: "/Photos/Backup/"}
+	if !w.Valid() {
+		t.Fatal("Valid() = false")
+	}
+	if got := fake.statuses["PROPFIND"]; len(got) != 1 || got[0] != http.StatusMultiStatus {
+		t.Errorf("PROPFIND statuses %v, want one 207", got)
+	}
+
+	meta, err := w.Upload(m1, p1)
+	if err != nil {
+		t.Fatalf("Upload() error %v", err)
+	}
+	if want := "Photos/Backup/2021-05-06/1_IMG #1 (a).jpg"; meta != want {
+		t.Errorf("Upload() meta = %s, want %s", meta, want)
+	}
+	if got, _ := fake.read(t, "/"+meta); got != "first" {
+		t.Errorf("uploaded %q, want first", got)
+	}
+	if got := fake.statuses["MKCOL"]; len(got) != 3 || count(got, http.StatusCreated) != 3 {
+		t.Errorf("MKCOL statuses %v, want 3 created", got)
+	}
+
+	// the folders are only made once by a syncer
+	if _, err := w.Upload(m2, p2); err != nil {
+		t.Fatalf("Upload() error %v", err)
+	}
+	if got := fake.statuses["MKCOL"]; len(got) != 3 {
+		t.Errorf("MKCOL statuses %v, want no new ones", got)
+	}
+
+	// a new syncer gets a 405 for the existing folders
+	w2 := &WebDAV{URL: w.URL, Username: "u", Password: "p", Folder: w.Folder}
+	meta2, err := w2.Upload(m2, p2)
+	if err != nil {
+		t.Fatalf("Upload() existing folders error %v", err)
+	}
+	if got := fake.statuses["MKCOL"]; count(got, http.StatusMethodNotAllowed) != 3 {
+		t.Errorf("MKCOL statuses %v, want 3 not allowed", got)
+	}
+	if got, _ := fake.read(t, "/Photos/Backup/2021-05-06/2_b.jpg"); got != "second" {
+		t.Errorf("uploaded %q, want second", got)
+	}
+	if got := fake.statuses["PUT"]; len(got) != 3 || count(got, http.StatusNoContent)+count(got, http.StatusCreated) != 3 {
+		t.Errorf("PUT statuses %v", got)
+	}
+
+	if err := w.Delete(meta); err != nil {
+		t.Fatalf("Delete() error %v", err)
+	}
+	if _, ok := fake.read(t, "/"+meta); ok {
+		t.Error("Delete() left the file")
+	}
+	// already deleted files are fine
+	if err := w.Delete(meta); err != nil {
+		t.Errorf("Delete() missing error %v", err)
+	}
+	if got := fake.statuses["DELETE"]; len(got) != 2 || got[1] != http.StatusNotFound {
+		t.Errorf("DELETE statuses %v, want the second 404", got)
+	}
+	if _, ok := fake.read(t, "/"+meta2); !ok {
+		t.Error("Delete() removed another file")
+	}
+
+	bad := &WebDAV{URL: srv.URL, Username: "u", Password: "wrong"}
+	_, err = bad.Upload(m1, p1)
+	if e, ok := err.(*webdavError); !ok || e.Method != "MKCOL" || e.Status != http.StatusUnauthorized {
+		t.Errorf("Upload() error %v, want MKCOL 401", err)
+	}
+	if bad.CanRetry(err) {
+		t.Error("CanRetry(401) = true")
+	}
+	for _, status := range []int{http.StatusLocked, http.StatusTooManyRequests, http.StatusBadGateway} {
+		if !bad.CanRetry(&webdavError{Method: http.MethodPut, Status: status}) {
+			t.Errorf("CanRetry(%d) = false", status)
+		}
+	}
+}
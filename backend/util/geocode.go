@@ -0,0 +1,125 @@
+package util
+
+import (
+	"bufio"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Place is a city from the GeoNames dataset
+	Place struct {
+		City    string
+		Country string
+		Lat     float64
+		Lon     float64
+	}
+
+	geoCell struct {
+		lat int
+		lon int
+	}
+)
+
+var (
+	// GeoNamesPath is a GeoNames cities file like cities15000.txt from https://download.geonames.org/export/dump/,
+	// set with GEONAMES_PATH and defaults to one in DATA_PATH
+	GeoNamesPath string
+
+	geoOnce  sync.Once
+	geoCells map[geoCell][]Place
+)
+
+func loadGeoNames() {
+	geoCells = make(map[geoCell][]Place)
+	GeoNamesPath = os.Getenv("GEONAMES_PATH")
+	// one in DATA_PATH is used when GEONAMES_PATH is unset or missing like in an image built without it
+	if GeoNamesPath == "" || !FileExists(GeoNamesPath) {
+		GeoNamesPath = filepath.Join(DataPath, "cities15000.txt")
+	}
+	file, err := os.Open(GeoNamesPath)
+	if err != nil {
+		log.Printf("Set GEONAMES_PATH env var to a GeoNames cities file for places: %v", err)
+		return
+	}
+	defer file.Close()
+	total := 0
+	scanner := bufio.NewScanner(file)
+	// lines with many alternate names go past the default limit
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// geonameid, name, asciiname, alternatenames, latitude, longitude, feature class,
+		// feature code, country code, ...
+		cols := strings.Split(scanner.Text(), "\t")
+		if len(cols) < 9 {
+			continue
+		}
+		lat, err := strconv.ParseFloat(cols[4], 64)
+		if err != nil {
+			continue
+		}
+		lon, err := strconv.ParseFloat(cols[5], 64)
+		if err != nil {
+			continue
+		}
+		p := Place{City: cols[1], Country: cols[8], Lat: lat, Lon: lon}
+		c := geoCellOf(lat, lon)
+		geoCells[c] = append(geoCells[c], p)
+		total++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("loadGeoNames read error: %v", err)
+	}
+	log.Printf("Loaded %d places from %s", total, GeoNamesPath)
+}
+
+func geoCellOf(lat float64, lon float64) geoCell {
+	return geoCell{lat: int(math.Floor(lat)), lon: int(math.Floor(lon))}
+}
+
+// HasGeoNames is true when a dataset with places was loaded, it's loaded on first use
+func HasGeoNames() bool {
+	geoOnce.Do(loadGeoNames)
+	return len(geoCells) > 0
+}
+
+// ReverseGeocode returns the nearest city within about a degree, false when there's none
+// or no dataset, the dataset is loaded on first use
+func ReverseGeocode(lat float64, lon float64) (*Place, bool) {
+	geoOnce.Do(loadGeoNames)
+	c := geoCellOf(lat, lon)
+	var (
+		nearest *Place
+		best    = math.MaxFloat64
+	)
+	for dLat := -1; dLat <= 1; dLat++ {
+		for dLon := -1; dLon <= 1; dLon++ {
+			// wrap around the antimeridian
+			cLon := (c.lon+dLon+180+360)%360 - 180
+			places := geoCells[geoCell{lat: c.lat + dLat, lon: cLon}]
+			for i := range places {
+				if d := Haversine(lat, lon, places[i].Lat, places[i].Lon); d < best {
+					best = d
+					nearest = &places[i]
+				}
+			}
+		}
+	}
+	return nearest, nearest != nil
+}
+
+// Haversine returns the distance in km between two coordinates
+func Haversine(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	const r = 6371
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * r * math.Asin(math.Sqrt(a))
+}
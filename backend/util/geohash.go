@@ -0,0 +1,53 @@
+package util
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Geohash encodes a coordinate, nearby points share a longer prefix the closer they are
+func Geohash(lat float64, lon float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	bit, ch, even := 0, 0, true
+	for len(hash) < precision {
+		rng, v := &latRange, lat
+		if even {
+			rng, v = &lonRange, lon
+		}
+		mid := (rng[0] + rng[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			rng[0] = mid
+		} else {
+			rng[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// GeohashPrecision is the geohash length whose cells are about a tile at a web map zoom level
+func GeohashPrecision(zoom int) int {
+	switch {
+	case zoom <= 2:
+		return 1
+	case zoom <= 4:
+		return 2
+	case zoom <= 7:
+		return 3
+	case zoom <= 9:
+		return 4
+	case zoom <= 12:
+		return 5
+	case zoom <= 14:
+		return 6
+	case zoom <= 16:
+		return 7
+	default:
+		return 8
+	}
+}
@@ -40,6 +40,7 @@ var MimeTypes = map[string]string{
 	".atx":         "application/vnd.antix.game-component",
 	".au":          "audio/basic",
 	".avi":         "video/x-msvideo",
+	".avif":        "image/avif",
 	".aw":          "application/applixware",
 	".azf":         "application/vnd.airzip.filesecure.azf",
 	".azs":         "application/vnd.airzip.filesecure.azs",
@@ -249,6 +250,8 @@ var MimeTypes = map[string]string{
 	".h264":        "video/h264",
 	".hbci":        "application/vnd.hbci",
 	".hdf":         "application/x-hdf",
+	".heic":        "image/heic",
+	".heif":        "image/heif",
 	".hh":          "text/x-c",
 	".hlp":         "application/winhlp",
 	".hpgl":        "application/vnd.hp-hpgl",
@@ -342,6 +345,7 @@ var MimeTypes = map[string]string{
 	".m2v":         "video/mpeg",
 	".m3a":         "audio/mpeg",
 	".m3u":         "audio/x-mpegurl",
+	".m3u8":        "application/vnd.apple.mpegurl",
 	".m4u":         "video/vnd.mpegurl",
 	".m4v":         "video/x-m4v",
 	".ma":          "application/mathematica",
@@ -693,6 +697,7 @@ var MimeTypes = map[string]string{
 	".tr":          "text/troff",
 	".tra":         "application/vnd.trueapp",
 	".trm":         "application/x-msterminal",
+	".ts":          "video/mp2t",
 	".tsv":         "text/tab-separated-values",
 	".ttc":         "application/x-font-ttf",
 	".ttf":         "application/x-font-ttf",
@@ -740,6 +745,7 @@ var MimeTypes = map[string]string{
 	".wbxml":       "application/vnd.wap.wbxml",
 	".wcm":         "application/vnd.ms-works",
 	".wdb":         "application/vnd.ms-works",
+	".webp":        "image/webp",
 	".wiz":         "application/msword",
 	".wks":         "application/vnd.ms-works",
 	".wm":          "video/x-ms-wm",
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+
+	resizer "github.com/nfnt/resize"
+)
+
+// DHash returns the 64 bit difference hash of an image, visually similar images
+// have a small hamming distance even after resizing or re-encoding
+func DHash(img image.Image) uint64 {
+	small := resizer.Resize(9, 8, img, resizer.Bilinear)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(x, y)).(color.Gray).Y
+			right := color.GrayModel.Convert(small.At(x+1, y)).(color.Gray).Y
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HammingDistance counts the bits that differ between two hashes
+func HammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type (
+	// Rendition is one quality level of an HLS ladder
+	Rendition struct {
+		Height  int
+		Bitrate int
+	}
+)
+
+var (
+	// HLSLadder are the renditions produced when HLS is enabled, heights above the source are skipped
+	HLSLadder = []Rendition{
+		{Height: 360, Bitrate: 800000},
+		{Height: 720, Bitrate: 2800000},
+		{Height: 1080, Bitrate: 5000000},
+	}
+)
+
+// TranscodeMP4 writes an H.264/AAC MP4 of input that plays in browsers and older devices
+func TranscodeMP4(input string, output string) error {
+	out, err := exec.Command("ffmpeg", "-y", "-i", input,
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "128k", "-movflags", "+faststart", "-f", "mp4", output).Output()
+	if err != nil {
+		return err
+	}
+	if len(out) > 0 {
+		log.Printf("TranscodeMP4: %s", string(out))
+	}
+	return nil
+}
+
+// TranscodeHLS writes an HLS ladder of input in dir with a master.m3u8 playlist, renditions
+// are sized by the short side so portrait videos get the same quality, baseURL is prepended
+// to every uri in the playlists
+func TranscodeHLS(input string, dir string, width int, height int, baseURL string) error {
+	portrait := width > 0 && width < height
+	short := height
+	if portrait {
+		short = width
+	}
+	master := []string{"#EXTM3U", "#EXT-X-VERSION:3"}
+	for i, r := range HLSLadder {
+		// always keep the smallest one for sources shorter than it
+		if r.Height > short && i > 0 {
+			break
+		}
+		name := fmt.Sprintf("%dp", r.Height)
+		scale := fmt.Sprintf("scale=-2:%d", r.Height)
+		if portrait {
+			scale = fmt.Sprintf("scale=%d:-2", r.Height)
+		}
+		out, err := exec.Command("ffmpeg", "-y", "-i", input,
+			"-vf", scale,
+			"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+			"-b:v", fmt.Sprint(r.Bitrate), "-maxrate", fmt.Sprint(r.Bitrate*3/2), "-bufsize", fmt.Sprint(r.Bitrate*2),
+			"-c:a", "aac", "-b:a", "128k",
+			"-f", "hls", "-hls_time", "6", "-hls_playlist_type", "vod",
+			"-hls_base_url", baseURL,
+			"-hls_segment_filename", filepath.Join(dir, name+"_%03d.ts"),
+			filepath.Join(dir, name+".m3u8")).Output()
+		if err != nil {
+			return err
+		}
+		if len(out) > 0 {
+			log.Printf("TranscodeHLS: %s", string(out))
+		}
+		inf := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", r.Bitrate+128000)
+		if portrait {
+			inf += fmt.Sprintf(",RESOLUTION=%dx%d", r.Height, height*r.Height/width/2*2)
+		} else if height > 0 {
+			inf += fmt.Sprintf(",RESOLUTION=%dx%d", width*r.Height/height/2*2, r.Height)
+		}
+		master = append(master, inf, baseURL+name+".m3u8")
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "master.m3u8"), []byte(strings.Join(master, "\n")+"\n"), 0644)
+}
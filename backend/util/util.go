@@ -18,6 +18,18 @@ import (
 
 var (
 	DataPath string
+	// MaxUploadSize in bytes, 0 means no limit
+	MaxUploadSize int64
+	// UploadSessionTTL is how long a resumable upload is kept without receiving data
+	UploadSessionTTL = time.Hour * 24
+	// HLSEnabled adds an HLS ladder to transcoded videos
+	HLSEnabled bool
+	// JobWorkers is how many background jobs run at the same time
+	JobWorkers = 2
+	// HasFFmpeg is set when ffmpeg is in the PATH at start, it's needed for WebP output
+	HasFFmpeg bool
+	// SyncLocalRoots are the directories any user can mirror to, without them only admins can
+	SyncLocalRoots []string
 
 	uid           *shortid.Shortid
 	dateRegex     = regexp.MustCompile(`(\d{4})-(\d{2})-(\d{2})`)
@@ -34,6 +46,28 @@ func init() {
 		log.Printf("Set DATA_PATH env var to set the location of media storage")
 		DataPath = filepath.Join("..", "data")
 	}
+	if mb := Atoi64(os.Getenv("MAX_UPLOAD_SIZE")); mb > 0 {
+		MaxUploadSize = mb * 1024 * 1024
+	} else {
+		log.Printf("Set MAX_UPLOAD_SIZE env var in MB to limit the size of uploaded media")
+	}
+	if h := Atoi64(os.Getenv("UPLOAD_SESSION_TTL")); h > 0 {
+		UploadSessionTTL = time.Hour * time.Duration(h)
+	}
+	HLSEnabled = os.Getenv("TRANSCODE_HLS") == "1"
+	if n := Atoi64(os.Getenv("JOB_WORKERS")); n > 0 {
+		JobWorkers = int(n)
+	}
+	for _, root := range filepath.SplitList(os.Getenv("SYNC_LOCAL_ROOTS")) {
+		if filepath.IsAbs(root) {
+			SyncLocalRoots = append(SyncLocalRoots, filepath.Clean(root))
+		}
+	}
+	if _, err := exec.LookPath("ffmpeg"); err == nil {
+		HasFFmpeg = true
+	} else {
+		log.Printf("Install ffmpeg for video details, HEIC thumbnails and WebP output")
+	}
 
 	sid, err := shortid.New(1, shortid.DefaultABC, 2342)
 	if err != nil {
@@ -53,13 +87,52 @@ func FileExists(path string) bool {
 	return true
 }
 
+// Thumbnail extracts a frame of a video to input.jpg, black or blank frames are skipped
+// and when every candidate is one the most detailed of them is used
 func Thumbnail(input string) error {
-	out, err := exec.Command("ffmpeg", "-i", input, "-ss", "00:00:01.000", "-vframes", "1", input+".jpg").Output()
+	var (
+		best      string
+		bestScore = -1.0
+		frames    []string
+		lastErr   error
+	)
+	defer func() {
+		for _, f := range frames {
+			os.Remove(f)
+		}
+	}()
+	for i, at := range frameTimes(VideoDuration(VideoInfo(input))) {
+		frame := fmt.Sprintf("%s.%d.jpg", input, i)
+		if err := extractFrame(input, at, frame); err != nil {
+			lastErr = err
+			continue
+		}
+		frames = append(frames, frame)
+		score, blank := frameScore(frame)
+		if !blank {
+			return os.Rename(frame, input+".jpg")
+		}
+		if score > bestScore {
+			best, bestScore = frame, score
+		}
+	}
+	if best == "" {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("Thumbnail no frames in %s", input)
+		}
+		return lastErr
+	}
+	return os.Rename(best, input+".jpg")
+}
+
+// ConvertImage converts the first frame of input with ffmpeg, the format comes from the output extension
+func ConvertImage(input string, output string) error {
+	out, err := exec.Command("ffmpeg", "-y", "-i", input, "-frames:v", "1", output).Output()
 	if err != nil {
 		return err
 	}
 	if len(out) > 0 {
-		log.Printf("Thumbnail: %s", string(out))
+		log.Printf("ConvertImage: %s", string(out))
 	}
 	return nil
 }
@@ -123,17 +196,6 @@ func TimeFromString(p string) (time.Time, bool) {
 	return now, false
 }
 
-func TimeFromPath(p string) time.Time {
-	now, ok := TimeFromString(p)
-	if !ok {
-		fi, err := os.Stat(p)
-		if err == nil {
-			return fi.ModTime()
-		}	
-	}
-	return now
-}
-
 func TypeByExt(ext string) string {
 	ext = strings.ToLower(ext)
 	if val, ok := MimeTypes[ext]; ok {
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+
+	resizer "github.com/nfnt/resize"
+)
+
+const (
+	// SpriteFrames is the number of tiles in a video sprite strip
+	SpriteFrames = 10
+	// SpriteWidth is the width of each tile in a video sprite strip
+	SpriteWidth = 160
+)
+
+// VideoDuration returns the duration in seconds from ffprobe info, 0 when unknown
+func VideoDuration(info map[string]interface{}) float64 {
+	format, _ := info["format"].(map[string]interface{})
+	d, _ := format["duration"].(string)
+	duration, _ := strconv.ParseFloat(d, 64)
+	return duration
+}
+
+// frameTimes are the offsets tried for a video thumbnail, starting at 1 second
+// then spread through the video for clips that open black or fade in
+func frameTimes(duration float64) []float64 {
+	if duration <= 0 {
+		return []float64{1, 0}
+	}
+	times := []float64{}
+	if duration > 1 {
+		times = append(times, 1)
+	}
+	for _, f := range []float64{0.1, 0.25, 0.5, 0.75} {
+		if t := duration * f; t > 1 || duration <= 1 {
+			times = append(times, t)
+		}
+	}
+	return times
+}
+
+func extractFrame(input string, at float64, output string) error {
+	out, err := exec.Command("ffmpeg", "-y", "-ss", fmt.Sprintf("%.3f", at), "-i", input, "-frames:v", "1", output).Output()
+	if err != nil {
+		return err
+	}
+	if len(out) > 0 {
+		log.Printf("extractFrame: %s", string(out))
+	}
+	if !FileExists(output) {
+		return fmt.Errorf("extractFrame no frame at %.3f", at)
+	}
+	return nil
+}
+
+// frameScore returns the luma standard deviation of a frame and if it looks black or blank
+func frameScore(fPath string) (float64, bool) {
+	file, err := os.Open(fPath)
+	if err != nil {
+		return 0, true
+	}
+	defer file.Close()
+	img, err := jpeg.Decode(file)
+	if err != nil {
+		return 0, true
+	}
+	small := resizer.Resize(32, 32, img, resizer.Bilinear)
+	var sum, sq float64
+	b := small.Bounds()
+	n := float64(b.Dx() * b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			l := float64(color.GrayModel.Convert(small.At(x, y)).(color.Gray).Y)
+			sum += l
+			sq += l * l
+		}
+	}
+	mean := sum / n
+	stddev := math.Sqrt(math.Max(sq/n-mean*mean, 0))
+	return stddev, mean < 20 || stddev < 8
+}
+
+// SpriteSheet writes a horizontal strip of SpriteFrames tiles evenly spread through the video
+// for hover scrubbing, each tile is SpriteWidth wide
+func SpriteSheet(input string, duration float64, output string) error {
+	if duration <= 0 {
+		return fmt.Errorf("SpriteSheet unknown duration")
+	}
+	out, err := exec.Command("ffmpeg", "-y", "-i", input,
+		"-vf", fmt.Sprintf("fps=%f,scale=%d:-2,tile=%dx1", SpriteFrames/duration, SpriteWidth, SpriteFrames),
+		"-frames:v", "1", "-f", "image2", output).Output()
+	if err != nil {
+		return err
+	}
+	if len(out) > 0 {
+		log.Printf("SpriteSheet: %s", string(out))
+	}
+	return nil
+}